@@ -0,0 +1,52 @@
+package main
+
+import (
+	"dexgate/pkg/devissuer"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"net"
+	"net/http"
+	"os"
+)
+
+// runDevIssuer run the built-in OIDC issuer ('dexgate dev-issuer' command), instead of the proxy. For development and testing only.
+func runDevIssuer(args []string) {
+	flags := pflag.NewFlagSet("dev-issuer", pflag.ExitOnError)
+	configFile := flags.String("config", "devissuer.yml", "Users and clients file")
+	bindAddr := flags.String("bindAddr", "127.0.0.1:5556", "The address to listen on.")
+	issuerURL := flags.String("issuer", "", "The issuer URL. Default: the config file one, or http://<bindAddr>")
+	logLevel := flags.String("logLevel", "INFO", "Log level (PANIC|FATAL|ERROR|WARN|INFO|DEBUG|TRACE)")
+	flags.SortFlags = false
+	_ = flags.Parse(args)
+
+	level, err := logrus.ParseLevel(*logLevel)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "\n%s is an invalid value for logLevel\n", *logLevel)
+		os.Exit(2)
+	}
+	// A dedicated logger, to not change the level of the standard one
+	logger := logrus.New()
+	logger.SetLevel(level)
+	devLog := logger.WithFields(logrus.Fields{"component": "dev-issuer"})
+
+	defaultIssuer := "http://" + *bindAddr
+	if host, port, err := net.SplitHostPort(*bindAddr); err == nil && host == "" {
+		defaultIssuer = "http://127.0.0.1:" + port
+	}
+	issuerConfig, err := devissuer.LoadConfig(*configFile, defaultIssuer)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "ERROR: Unable to load config file: %v\n", err)
+		os.Exit(2)
+	}
+	if *issuerURL != "" {
+		issuerConfig.Issuer = *issuerURL
+	}
+	issuer, err := devissuer.New(issuerConfig, devLog)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "ERROR: Invalid config file '%s': %v\n", *configFile, err)
+		os.Exit(2)
+	}
+	devLog.Warnf("Development OIDC issuer '%s' listening at '%s' (%d users). NOT FOR PRODUCTION USE", issuer.URL(), *bindAddr, len(issuerConfig.Users))
+	devLog.Fatal(http.ListenAndServe(*bindAddr, issuer))
+}
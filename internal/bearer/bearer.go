@@ -0,0 +1,74 @@
+package bearer
+
+import (
+	"context"
+	"dexgate/internal/oidcapp"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Validator check a bearer token provided by an API or CLI client, and return the associated claims.
+type Validator interface {
+	Validate(ctx context.Context, token string) (claims string, err error)
+}
+
+// errNotHandled is returned by a Validator for a token which is not of its kind. A chain then reports the error of another one
+var errNotHandled = errors.New("token not handled by this validator")
+
+// GetToken extract the bearer token from the request 'Authorization' header. See RFC 6750, section 2.1
+func GetToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(auth[7:])
+	return token, token != ""
+}
+
+type jwtValidator struct {
+	providers *oidcapp.Providers
+}
+
+// NewJWTValidator return a Validator for JWT issued by one of the OIDC providers. The provider is selected by the token issuer,
+// and its bearer audiences apply.
+func NewJWTValidator(providers *oidcapp.Providers) Validator {
+	return &jwtValidator{
+		providers: providers,
+	}
+}
+
+func (this *jwtValidator) Validate(ctx context.Context, token string) (string, error) {
+	oidcApp, err := this.providers.ForToken(token)
+	if err != nil {
+		return "", fmt.Errorf("failed to verify bearer token: %v", err)
+	}
+	return oidcApp.VerifyBearerToken(ctx, token)
+}
+
+type chainValidator struct {
+	validators []Validator
+}
+
+// NewChainValidator return a Validator trying each of the provided ones in turn, up to the first success.
+// On failure, the error of the last validator which handled the token is returned.
+func NewChainValidator(validators ...Validator) Validator {
+	return &chainValidator{
+		validators: validators,
+	}
+}
+
+func (this *chainValidator) Validate(ctx context.Context, token string) (string, error) {
+	var err error
+	for _, validator := range this.validators {
+		claims, vErr := validator.Validate(ctx, token)
+		if vErr == nil {
+			return claims, nil
+		}
+		if err == nil || !errors.Is(vErr, errNotHandled) {
+			err = vErr
+		}
+	}
+	return "", err
+}
@@ -0,0 +1,65 @@
+package bearer
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// resultCache is a bounded cache of validation results, each with its own expiry.
+// When full, the least recently used entry is evicted.
+type resultCache struct {
+	mutex   sync.Mutex
+	maxSize int
+	entries map[string]*list.Element
+	lru     *list.List // Front is most recently used
+}
+
+type cacheEntry struct {
+	key    string
+	claims string
+	err    error
+	expiry time.Time
+}
+
+func newResultCache(maxSize int) *resultCache {
+	return &resultCache{
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *resultCache) get(key string) (entry *cacheEntry, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry = element.Value.(*cacheEntry)
+	if time.Now().After(entry.expiry) {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return entry, true
+}
+
+func (c *resultCache) put(key string, claims string, err error, expiry time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry := &cacheEntry{key: key, claims: claims, err: err, expiry: expiry}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -0,0 +1,156 @@
+package bearer
+
+import (
+	"context"
+	"crypto/sha256"
+	"dexgate/internal/identity"
+	"dexgate/internal/oidcapp"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type introspectionValidator struct {
+	providers       *oidcapp.Providers
+	oidcApp         *oidcapp.OidcApp
+	mapping         *identity.Mapping
+	groupsAttribute string
+	cacheTTL        time.Duration
+	cache           *resultCache
+}
+
+// NewIntrospectionValidator return a Validator for opaque tokens, using the OIDC server introspection endpoint (RFC 7662).
+// The token 'aud' (Or 'client_id', if there is no 'aud') must be one of the provider bearer audiences, and its 'client_id' is checked
+// against the provider authorized parties, as for a JWT. JWT issued by one of the providers are not handled:
+// They must be validated locally. The user identity is provided under the mapping paths, as for a JWT.
+// Results, positive or negative, are cached up to cacheTTL.
+func NewIntrospectionValidator(providers *oidcapp.Providers, oidcApp *oidcapp.OidcApp, mapping *identity.Mapping, groupsAttribute string, cacheTTL time.Duration, cacheSize int) Validator {
+	return &introspectionValidator{
+		providers:       providers,
+		oidcApp:         oidcApp,
+		mapping:         mapping,
+		groupsAttribute: groupsAttribute,
+		cacheTTL:        cacheTTL,
+		cache:           newResultCache(cacheSize),
+	}
+}
+
+func (this *introspectionValidator) Validate(ctx context.Context, token string) (string, error) {
+	if _, err := this.providers.ForToken(token); err == nil {
+		return "", fmt.Errorf("%w: JWT issued by a configured provider", errNotHandled)
+	}
+	// Don't keep the tokens themselves in memory
+	hash := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(hash[:])
+	if entry, ok := this.cache.get(key); ok {
+		return entry.claims, entry.err
+	}
+	attributes, err := this.oidcApp.Introspect(ctx, token)
+	if err != nil {
+		// Technical error. Not cached
+		return "", err
+	}
+	expiry := time.Now().Add(this.cacheTTL)
+	claims, err := this.toClaims(attributes)
+	if err == nil {
+		if exp, ok := numericAttribute(attributes, "exp"); ok {
+			tokenExpiry := time.Unix(exp, 0)
+			if tokenExpiry.Before(expiry) {
+				expiry = tokenExpiry
+			}
+		}
+	}
+	this.cache.put(key, claims, err, expiry)
+	return claims, err
+}
+
+// toClaims map the introspection response to the claims evaluated by the UserFilter
+func (this *introspectionValidator) toClaims(attributes map[string]interface{}) (string, error) {
+	if active, _ := attributes["active"].(bool); !active {
+		return "", fmt.Errorf("token is not active")
+	}
+	if exp, ok := numericAttribute(attributes, "exp"); ok && time.Now().After(time.Unix(exp, 0)) {
+		return "", fmt.Errorf("token is expired")
+	}
+	// 'aud' is optional in the introspection response. The client the token was issued to then stands for it
+	audiences := stringsValue(attributes["aud"])
+	clientID, _ := attributes["client_id"].(string)
+	if len(audiences) > 0 {
+		if !oidcapp.ContainsOneOf(audiences, this.oidcApp.BearerAudiences()) {
+			return "", fmt.Errorf("token audience %q does not match any of the allowed audiences", audiences)
+		}
+	} else if !oidcapp.ContainsOneOf([]string{clientID}, this.oidcApp.BearerAudiences()) {
+		return "", fmt.Errorf("token has no audience, and its client_id '%s' does not match any of the allowed audiences", clientID)
+	}
+	// Same authorized party check as for a JWT issued by the introspecting provider
+	if err := this.oidcApp.CheckBearerAuthorizedParty(clientID); err != nil {
+		return "", fmt.Errorf("token client_id: %v", err)
+	}
+	claims := make(map[string]interface{})
+	for name, value := range attributes {
+		claims[name] = value
+	}
+	// Allow issuer specific user rules. The introspecting server can only vouch for itself
+	claims["iss"] = this.oidcApp.IssuerURL()
+	id, err := this.mapping.FromMap(claims)
+	if err != nil {
+		return "", fmt.Errorf("unable to map the introspection claims: %v", err)
+	}
+	if id.Username == "" {
+		// Standard introspection attribute
+		id.Username, _ = attributes["username"].(string)
+	}
+	groupsAttribute := this.groupsAttribute
+	if groupsAttribute == "" {
+		groupsAttribute = this.mapping.GroupsPath()
+	}
+	id.Groups = nil
+	if groups, ok := identity.Lookup(attributes, groupsAttribute); ok {
+		switch g := groups.(type) {
+		case string:
+			// Space-separated list, as for the 'scope' attribute
+			id.Groups = strings.Fields(g)
+		case []interface{}:
+			id.Groups = stringsValue(g)
+		default:
+			return "", fmt.Errorf("unexpected type for '%s' introspection attribute", groupsAttribute)
+		}
+	}
+	this.mapping.ToClaims(id, claims)
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("unable to encode introspection claims: %v", err)
+	}
+	return string(data), nil
+}
+
+// stringsValue return a string or array of strings attribute value (i.e. 'aud') as a slice
+func stringsValue(attribute interface{}) []string {
+	switch value := attribute.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func numericAttribute(attributes map[string]interface{}, name string) (int64, bool) {
+	number, ok := attributes[name].(json.Number)
+	if !ok {
+		return 0, false
+	}
+	value, err := number.Float64()
+	if err != nil {
+		return 0, false
+	}
+	return int64(value), true
+}
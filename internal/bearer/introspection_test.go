@@ -0,0 +1,136 @@
+package bearer
+
+import (
+	"dexgate/internal/config"
+	"dexgate/internal/identity"
+	"dexgate/internal/oidcapp"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testIssuer = "http://127.0.0.1:1/dex"
+
+func init() {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	config.Log = logrus.NewEntry(logger)
+}
+
+func newTestIntrospectionValidator(t *testing.T, claimsConfig config.ClaimsConfig, groupsAttribute string) *introspectionValidator {
+	// Discovery is never performed: The tested mapping doesn't need it
+	oidcApp, err := oidcapp.NewOidcApp(&config.OidcConfig{
+		Name:            "default",
+		ClientID:        "dexgate",
+		IssuerURL:       testIssuer,
+		BearerAudiences: []string{"dexgate", "api"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(oidcApp.Close)
+	return NewIntrospectionValidator(nil, oidcApp, identity.NewMapping(claimsConfig), groupsAttribute, time.Minute, 10).(*introspectionValidator)
+}
+
+func TestIntrospectionClaims(t *testing.T) {
+	defaultMapping := config.ClaimsConfig{Username: "name", Email: "email", EmailVerified: "email_verified", Groups: "groups"}
+	keycloakMapping := config.ClaimsConfig{Username: "preferred_username", Email: "email", EmailVerified: "email_verified", Groups: "realm_access.roles"}
+	tests := []struct {
+		name            string
+		mapping         config.ClaimsConfig
+		groupsAttribute string
+		response        string
+		identity        *identity.Identity // nil if the token must be rejected
+	}{
+		{
+			name:     "default mapping",
+			mapping:  defaultMapping,
+			response: `{"active": true, "aud": "dexgate", "username": "john", "groups": ["dev", "ops"]}`,
+			identity: &identity.Identity{Issuer: testIssuer, Username: "john", Groups: []string{"dev", "ops"}},
+		},
+		{
+			name:     "space separated groups",
+			mapping:  defaultMapping,
+			response: `{"active": true, "aud": ["other", "api"], "name": "John", "username": "john", "groups": "dev ops"}`,
+			identity: &identity.Identity{Issuer: testIssuer, Username: "John", Groups: []string{"dev", "ops"}},
+		},
+		{
+			name:     "nested mapping",
+			mapping:  keycloakMapping,
+			response: `{"active": true, "client_id": "dexgate", "username": "john", "realm_access": {"roles": ["admin"]}, "groups": ["ignored"]}`,
+			identity: &identity.Identity{Issuer: testIssuer, Username: "john", Groups: []string{"admin"}},
+		},
+		{
+			name:     "mapped username",
+			mapping:  keycloakMapping,
+			response: `{"active": true, "aud": "dexgate", "username": "jdoe", "preferred_username": "john"}`,
+			identity: &identity.Identity{Issuer: testIssuer, Username: "john", Groups: []string{}},
+		},
+		{
+			name:            "groups attribute",
+			mapping:         keycloakMapping,
+			groupsAttribute: "roles",
+			response:        `{"active": true, "aud": "dexgate", "username": "john", "roles": "dev", "realm_access": {"roles": ["admin"]}}`,
+			identity:        &identity.Identity{Issuer: testIssuer, Username: "john", Groups: []string{"dev"}},
+		},
+		{
+			name:            "missing groups attribute",
+			mapping:         keycloakMapping,
+			groupsAttribute: "roles",
+			response:        `{"active": true, "aud": "dexgate", "username": "john", "realm_access": {"roles": ["admin"]}}`,
+			identity:        &identity.Identity{Issuer: testIssuer, Username: "john", Groups: []string{}},
+		},
+		{
+			name:     "issuer is forced",
+			mapping:  defaultMapping,
+			response: `{"active": true, "aud": "dexgate", "iss": "https://other", "username": "john"}`,
+			identity: &identity.Identity{Issuer: testIssuer, Username: "john", Groups: []string{}},
+		},
+		{
+			name:     "inactive",
+			mapping:  defaultMapping,
+			response: `{"active": false, "aud": "dexgate", "username": "john"}`,
+		},
+		{
+			name:     "other audience",
+			mapping:  defaultMapping,
+			response: `{"active": true, "aud": "other", "client_id": "dexgate", "username": "john"}`,
+		},
+		{
+			name:     "invalid groups",
+			mapping:  defaultMapping,
+			response: `{"active": true, "aud": "dexgate", "username": "john", "groups": 42}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			validator := newTestIntrospectionValidator(t, test.mapping, test.groupsAttribute)
+			decoder := json.NewDecoder(strings.NewReader(test.response))
+			decoder.UseNumber()
+			var attributes map[string]interface{}
+			if err := decoder.Decode(&attributes); err != nil {
+				t.Fatal(err)
+			}
+			claims, err := validator.toClaims(attributes)
+			if test.identity == nil {
+				if err == nil {
+					t.Fatalf("expected the token to be rejected, got %s", claims)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, err := identity.NewMapping(test.mapping).FromClaims(claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id.Issuer != test.identity.Issuer || id.Username != test.identity.Username || strings.Join(id.Groups, ",") != strings.Join(test.identity.Groups, ",") {
+				t.Errorf("expected %+v, got %+v (claims: %s)", test.identity, id, claims)
+			}
+		})
+	}
+}
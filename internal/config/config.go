@@ -2,6 +2,7 @@ package config
 
 import (
 	"github.com/sirupsen/logrus"
+	"net/http"
 	"net/url"
 	"time"
 )
@@ -16,16 +17,34 @@ var logLevelByString = map[string]logrus.Level{
 	"TRACE": logrus.TraceLevel,
 }
 
+var sameSiteByString = map[string]http.SameSite{
+	"Lax":    http.SameSiteLaxMode,
+	"Strict": http.SameSiteStrictMode,
+	"None":   http.SameSiteNoneMode,
+}
+
 // Exported globale variables
 var (
-	Conf            Config
-	TargetURL       *url.URL
-	Log             *logrus.Entry
-	IdleTimeout     time.Duration
-	SessionLifetime time.Duration
+	Conf                  Config
+	TargetURL             *url.URL
+	Log                   *logrus.Entry
+	IdleTimeout           time.Duration
+	SessionLifetime       time.Duration
+	LoginTimeout          time.Duration
+	MaxAuthAge            time.Duration
+	CookieSameSite        http.SameSite
+	IntrospectionCacheTTL time.Duration
+)
+
+// Provider types
+const (
+	ProviderTypeOIDC   = "oidc"
+	ProviderTypeOAuth2 = "oauth2"
 )
 
 type OidcConfig struct {
+	Name             string   `yaml:"name"`             // Provider identifier, used in URLs and session. Mandatory if more than one provider. Default: 'default'
+	DisplayName      string   `yaml:"displayName"`      // Label of the provider on the login chooser page. Default: name
 	ClientID         string   `yaml:"clientID"`         // OAuth2 client ID of this application.
 	ClientIDEnv      string   `yaml:"clientIDEnv"`      // An environment variable for OAuth2 client ID of this application.
 	ClientSecret     string   `yaml:"clientSecret"`     // "OAuth2 client secret of this application."
@@ -36,11 +55,115 @@ type OidcConfig struct {
 	RootCAFile       string   `yaml:"rootCAFile"`       // The root CA file for validation of IssuerURL
 	LoginURLOverride string   `yaml:"loginURLOverride"` // Allow overriding of scheme and host part of the login URL provided by the OIDC server
 	Debug            bool     `yaml:"debug"`            // Print all request and responses from the OpenID Connect issuer.
+	PKCE             *bool    `yaml:"pkce"`             // Use PKCE (S256) in the authorization code flow. Default: true
+	// Where the user land after logout. Sent to the OIDC server as post_logout_redirect_uri, so must be registered there.
+	PostLogoutRedirectURL string `yaml:"postLogoutRedirectURL"`
+	UseUserInfo           bool   `yaml:"useUserInfo"`        // Fetch UserInfo on login and merge them in the ID token claims
+	UserInfoPrecedence    string `yaml:"userInfoPrecedence"` // Which source win if a claim is in both: 'idToken' or 'userInfo'. Default: idToken
+	// How often the discovery document and signing keys are fetched again. '0' to disable. Default: 1h
+	MetadataRefreshInterval string        `yaml:"metadataRefreshInterval"`
+	MetadataRefreshPeriod   time.Duration `yaml:"-"` // Parsed from MetadataRefreshInterval
+	// A PEM file hosting a RSA or EC private key. If set, dexgate authenticate with a signed JWT (private_key_jwt), instead of a client secret
+	ClientAssertionKeyFile string          `yaml:"clientAssertionKeyFile"`
+	ClientAssertionKeyID   string          `yaml:"clientAssertionKeyID"` // The 'kid' of the above key. Default: The key thumbprint (RFC 7638)
+	Transport              TransportConfig `yaml:"transport"`            // HTTP connections to the OIDC server
+	// Additional parameters for the authorization request (i.e. Dex 'connector_id')
+	ExtraAuthParams map[string]string `yaml:"extraAuthParams"`
+	// Query parameters of the requested URL forwarded to the authorization request (i.e. 'login_hint', 'ui_locales')
+	AuthParamsPassthrough []string `yaml:"authParamsPassthrough"`
+	// How the OIDC server return the authorization response: 'query' (Redirect) or 'form_post'. Default: query
+	ResponseMode string `yaml:"responseMode"`
+	// The OIDC server endpoints, for servers not providing a discovery document. If set, discovery is not performed
+	Endpoints *EndpointsConfig `yaml:"endpoints"`
+	// 'oidc', or 'oauth2' for plain OAuth2 servers (i.e. GitHub), without ID token. Default: oidc
+	Type   string       `yaml:"type"`
+	OAuth2 OAuth2Config `yaml:"oauth2"` // User identity retrieval, for 'oauth2' type
+	// Audience, authorized party, clock skew and signing algorithms checks of the ID tokens and bearer tokens issued by this provider
+	TokenValidation TokenValidationConfig `yaml:"tokenValidation"`
+	// Bearer tokens issued by this provider must have one of these audiences. From bearer.audiences, or clientID and tokenValidation.audiences
+	BearerAudiences []string `yaml:"-"`
+	// Pending device authorizations on this provider, beyond which new ones are refused. From device.maxPending
+	DeviceMaxPending int `yaml:"-"`
+}
+
+// TokenValidationConfig tune the validation of the tokens issued by a provider.
+type TokenValidationConfig struct {
+	Audiences              []string      `yaml:"audiences"`              // ID token audiences accepted besides the client ID (i.e. Dex cross-client peers)
+	AuthorizedParties      []string      `yaml:"authorizedParties"`      // Accepted 'azp' claim values. Default: [clientID]
+	RequireAuthorizedParty bool          `yaml:"requireAuthorizedParty"` // The 'azp' claim is mandatory
+	ClockSkew              string        `yaml:"clockSkew"`              // Tolerance on token expiration. Default: 0s
+	ClockSkewDuration      time.Duration `yaml:"-"`                      // Parsed from ClockSkew
+	SigningAlgs            []string      `yaml:"signingAlgs"`            // Accepted signing algorithms. Default: the ones supported by the provider
+}
+
+// OAuth2Config define how to get the user identity from a plain OAuth2 server, using the access token.
+type OAuth2Config struct {
+	UserURL      string `yaml:"userURL"`      // API endpoint providing the user information, as a JSON object. Mandatory
+	SubjectField string `yaml:"subjectField"` // The user unique identifier in the above object. Default: id
+	// API endpoint providing the user groups (i.e. organizations or teams), as a JSON array of strings or objects. Optional
+	GroupsURL   string   `yaml:"groupsURL"`
+	GroupFields []string `yaml:"groupFields"` // Fields of a groupsURL object making the group name, joined with '/'. Default: [login]
+	TrustEmail  bool     `yaml:"trustEmail"`  // Consider the user email as verified. Default: false
+}
+
+// EndpointsConfig define the OIDC server endpoints, when not provided by discovery
+type EndpointsConfig struct {
+	Authorization   string   `yaml:"authorization"`   // Mandatory
+	Token           string   `yaml:"token"`           // Mandatory
+	UserInfo        string   `yaml:"userinfo"`        // Mandatory if useUserInfo is set
+	JWKS            string   `yaml:"jwks"`            // Mandatory. Keys used to validate ID tokens signature
+	SigningAlgs     []string `yaml:"signingAlgs"`     // ID token signing algorithms. Default: ["RS256"]
+	ScopesSupported []string `yaml:"scopesSupported"` // If set, configured scopes are checked against this list. Default: No check
+}
+
+// TransportConfig define how dexgate connect to the OIDC server. Certificate files are reloaded on change.
+type TransportConfig struct {
+	CAFiles         []string `yaml:"caFiles"`         // Additional CAs, appended to the system ones (Or to rootCAFile, if defined)
+	ClientCertFile  string   `yaml:"clientCertFile"`  // Client certificate, for mutual TLS with the OIDC server
+	ClientKeyFile   string   `yaml:"clientKeyFile"`   // Private key of the above certificate
+	ProxyURL        string   `yaml:"proxyURL"`        // Default: From HTTPS_PROXY/HTTP_PROXY/NO_PROXY environment variables
+	DialTimeout     string   `yaml:"dialTimeout"`     // Default: 30s
+	TLSTimeout      string   `yaml:"tlsTimeout"`      // TLS handshake. Default: 10s
+	ResponseTimeout string   `yaml:"responseTimeout"` // Waiting for response headers. Default: 30s
+
+	Proxy            *url.URL      `yaml:"-"` // Parsed from ProxyURL
+	DialDuration     time.Duration `yaml:"-"` // Parsed from DialTimeout
+	TLSDuration      time.Duration `yaml:"-"` // Parsed from TLSTimeout
+	ResponseDuration time.Duration `yaml:"-"` // Parsed from ResponseTimeout
+}
+
+// OidcConfigs is a list of OIDC providers. For compatibility, a single provider may be defined as a map instead of a list.
+type OidcConfigs []OidcConfig
+
+func (c *OidcConfigs) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	if _, ok := raw.([]interface{}); ok {
+		var list []OidcConfig
+		if err := unmarshal(&list); err != nil {
+			return err
+		}
+		*c = list
+		return nil
+	}
+	var single OidcConfig
+	if err := unmarshal(&single); err != nil {
+		return err
+	}
+	*c = OidcConfigs{single}
+	return nil
 }
 
 type SessionConfig struct {
-	IdleTimeout string `yaml:"idleTimeout"` // The maximum length of time a session can be inactive before being expired
-	Lifetime    string `yaml:"lifetime"`    // The absolute maximum length of time that a session is valid.
+	IdleTimeout    string `yaml:"idleTimeout"`    // The maximum length of time a session can be inactive before being expired
+	Lifetime       string `yaml:"lifetime"`       // The absolute maximum length of time that a session is valid.
+	LoginTimeout   string `yaml:"loginTimeout"`   // The maximum length of time between login redirection and callback. Default: 10m
+	CapToIDToken   bool   `yaml:"capToIDToken"`   // The session can't be valid longer than the ID token it was built from
+	MaxAuthAge     string `yaml:"maxAuthAge"`     // If defined, the session can't be valid longer than this duration after the user authentication (auth_time claim)
+	CookieSameSite string `yaml:"cookieSameSite"` // SameSite attribute of the session cookie: 'Lax', 'Strict' or 'None'. Default: Lax
+	CookieSecure   bool   `yaml:"cookieSecure"`   // Set the Secure attribute of the session cookie. Required if cookieSameSite is 'None'
 }
 
 type UsersConfigMap struct {
@@ -49,16 +172,88 @@ type UsersConfigMap struct {
 	ConfigMapKey  string `yaml:"configMapKey"`  // Default to 'users.yml'
 }
 
+type IntrospectionConfig struct {
+	Enabled         bool   `yaml:"enabled"`         // Validate opaque tokens with the OIDC server introspection endpoint (RFC 7662)
+	Provider        string `yaml:"provider"`        // The name of the provider introspecting tokens. Required if there is several ones
+	GroupsAttribute string `yaml:"groupsAttribute"` // The introspection response attribute hosting user groups. Default: claims.groups
+	CacheTTL        string `yaml:"cacheTTL"`        // How long an introspection result is cached. Default: 1m
+	CacheSize       int    `yaml:"cacheSize"`       // Maximum number of cached introspection results. Default: 1000
+}
+
+type BearerConfig struct {
+	Enabled       bool                `yaml:"enabled"`       // Accept requests with an 'Authorization: Bearer <JWT>' header, without session
+	Audiences     []string            `yaml:"audiences"`     // The token 'aud' claim must contain one of these. Single provider only. Default: the provider clientID and tokenValidation.audiences
+	Introspection IntrospectionConfig `yaml:"introspection"` // Also accept opaque tokens, validated by introspection
+}
+
+type DeviceConfig struct {
+	Enabled    bool `yaml:"enabled"`    // Provide the /dg_device endpoints, for login from a CLI without browser (RFC 8628)
+	RateLimit  int  `yaml:"rateLimit"`  // Device authorizations a client address can start per minute. Default: 10
+	MaxPending int  `yaml:"maxPending"` // Pending device authorizations per provider, beyond which new ones are refused. Default: 1000
+}
+
+// StepUpConfig define a stronger authentication requirement for a path. A session which does not fulfill it must login again.
+type StepUpConfig struct {
+	Path       string   `yaml:"path"`       // URL path prefix the rule applies to
+	Acr        []string `yaml:"acr"`        // The session 'acr' claim must be one of these. Requested with 'acr_values'
+	Amr        []string `yaml:"amr"`        // The session 'amr' claim must contain one of these. Requested with 'prompt=login'
+	MaxAuthAge string   `yaml:"maxAuthAge"` // The user authentication ('auth_time' claim) must not be older. Requested with 'max_age'
+
+	MaxAuthAgeDuration time.Duration `yaml:"-"` // Parsed from MaxAuthAge
+}
+
+// SamlConfig define dexgate as a SAML 2.0 service provider (SP), as an alternative to OIDC
+type SamlConfig struct {
+	EntityID        string               `yaml:"entityID"`        // The SP entity ID. Default: the SP metadata URL (<rootURL>/dg_saml/metadata)
+	RootURL         string               `yaml:"rootURL"`         // The dexgate external URL (i.e. https://myapp.mycompany.com). Mandatory
+	IdpMetadataFile string               `yaml:"idpMetadataFile"` // The IdP metadata. Reloaded on change. Mandatory
+	Binding         string               `yaml:"binding"`         // How the authentication request is sent to the IdP: 'redirect' or 'post'. Default: redirect
+	KeyFile         string               `yaml:"keyFile"`         // SP private key (PEM), to sign the authentication requests. Optional
+	CertFile        string               `yaml:"certFile"`        // SP certificate (PEM), published in the SP metadata. Required with keyFile
+	NameIDFormat    string               `yaml:"nameIDFormat"`    // The requested NameID format. Default: none (IdP choice)
+	Attributes      SamlAttributesConfig `yaml:"attributes"`      // Mapping of assertion attributes to the user identity
+	TrustEmail      bool                 `yaml:"trustEmail"`      // Consider the user email as verified. Default: false
+}
+
+// SamlAttributesConfig define which assertion attribute (By Name or FriendlyName) provide each identity field
+type SamlAttributesConfig struct {
+	Name   string `yaml:"name"`   // Default: the assertion NameID
+	Email  string `yaml:"email"`  // Default: email
+	Groups string `yaml:"groups"` // Multi-valued. Default: groups
+}
+
+// ClaimsConfig define where the user identity is found in the claims. A path may be dotted, to reach a nested claim (i.e. 'realm_access.roles')
+type ClaimsConfig struct {
+	Username      string `yaml:"username"`      // Default: name
+	Email         string `yaml:"email"`         // Default: email
+	EmailVerified string `yaml:"emailVerified"` // Default: email_verified
+	Groups        string `yaml:"groups"`        // A string or an array of strings. Default: groups
+}
+
+// IdentityHeadersConfig define the request headers providing the user identity to the target application. Not sent if empty.
+type IdentityHeadersConfig struct {
+	Username string `yaml:"username"` // i.e. X-Forwarded-User
+	Email    string `yaml:"email"`    // i.e. X-Forwarded-Email
+	Groups   string `yaml:"groups"`   // Comma separated list. i.e. X-Forwarded-Groups
+}
+
 type Config struct {
 	configFolder    string
 	LogLevel        string         `yaml:"logLevel"`        // INFO,DEBUG, ....
 	LogMode         string         `yaml:"logMode"`         // Log output format: 'dev' or 'json'
 	BindAddr        string         `yaml:"bindAddr"`        // The address to listen on. (default to :9001)
 	TargetURL       string         `yaml:"targetURL"`       // The URL to forward all requests
-	OidcConfig      OidcConfig     `yaml:"oidc"`            // OIDC client config
+	OidcConfigs     OidcConfigs    `yaml:"oidc"`            // OIDC providers config. A single one or a list
+	Saml            *SamlConfig    `yaml:"saml"`            // SAML service provider config, instead of OIDC
 	Passthroughs    []string       `yaml:"passthroughs"`    // Paths pattern to forward without authentication (See http.ServeMux for path definition)
 	TokenDisplay    bool           `yaml:"tokenDisplay"`    // Display an intermediate token page after login (Debugging only)
 	SessionConfig   SessionConfig  `yaml:"sessionConfig"`   // Web session parameters
 	UsersConfigFile string         `yaml:"usersConfigFile"` // File hosting allowed users/groups
 	UsersConfigMap  UsersConfigMap `yaml:"usersConfigMap"`  //
+	Bearer          BearerConfig   `yaml:"bearer"`          // Bearer token authentication, for API and CLI clients
+	Device          DeviceConfig   `yaml:"device"`          // Device authorization grant, for CLI clients
+	StepUp          []StepUpConfig `yaml:"stepUp"`          // Per path stronger authentication requirements
+	Claims          ClaimsConfig   `yaml:"claims"`          // Mapping of the user identity in the claims
+	// Headers providing the user identity to the target application
+	IdentityHeaders IdentityHeadersConfig `yaml:"identityHeaders"`
 }
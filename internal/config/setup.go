@@ -5,12 +5,19 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 	"gopkg.in/yaml.v2"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
 	"time"
 )
 
+// Provider name is used in URL and session
+var providerNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
 func loadConfig(fileName string, config *Config) error {
 	configFile, err := filepath.Abs(fileName)
 	if err != nil {
@@ -74,23 +81,37 @@ func Setup() {
 	}
 
 	// Set relative to main config file. Performed before adjusting frmoo command line.
-	adjustPath(Conf.configFolder, &Conf.OidcConfig.RootCAFile)
 	adjustPath(Conf.configFolder, &Conf.UsersConfigFile)
 
 	adjustConfigString(pflag.CommandLine, &Conf.LogLevel, "logLevel")
 	adjustConfigString(pflag.CommandLine, &Conf.LogMode, "logMode")
 	adjustConfigString(pflag.CommandLine, &Conf.BindAddr, "bindAddr")
 	adjustConfigString(pflag.CommandLine, &Conf.TargetURL, "targetUrl")
-	adjustConfigBool(pflag.CommandLine, &Conf.OidcConfig.Debug, "oidcDebug")
 	adjustConfigBool(pflag.CommandLine, &Conf.TokenDisplay, "tokenDisplay")
 	adjustConfigString(pflag.CommandLine, &Conf.SessionConfig.IdleTimeout, "idleTimeout")
 	adjustConfigString(pflag.CommandLine, &Conf.SessionConfig.Lifetime, "sessionLifetime")
-	adjustConfigString(pflag.CommandLine, &Conf.OidcConfig.RootCAFile, "oidcRootCAFile")
 	adjustConfigString(pflag.CommandLine, &Conf.UsersConfigFile, "usersConfigFile")
 	adjustConfigString(pflag.CommandLine, &Conf.UsersConfigMap.Namespace, "usersConfigMapNamespace")
 	adjustConfigString(pflag.CommandLine, &Conf.UsersConfigMap.ConfigMapName, "usersConfigMapName")
 	adjustConfigString(pflag.CommandLine, &Conf.UsersConfigMap.ConfigMapKey, "usersConfigMapKey")
-	adjustConfigString(pflag.CommandLine, &Conf.OidcConfig.LoginURLOverride, "loginURLOverride")
+	// OIDC related command line parameters apply to all providers
+	for i := range Conf.OidcConfigs {
+		adjustPath(Conf.configFolder, &Conf.OidcConfigs[i].RootCAFile)
+		adjustPath(Conf.configFolder, &Conf.OidcConfigs[i].ClientAssertionKeyFile)
+		for j := range Conf.OidcConfigs[i].Transport.CAFiles {
+			adjustPath(Conf.configFolder, &Conf.OidcConfigs[i].Transport.CAFiles[j])
+		}
+		adjustPath(Conf.configFolder, &Conf.OidcConfigs[i].Transport.ClientCertFile)
+		adjustPath(Conf.configFolder, &Conf.OidcConfigs[i].Transport.ClientKeyFile)
+		adjustConfigBool(pflag.CommandLine, &Conf.OidcConfigs[i].Debug, "oidcDebug")
+		adjustConfigString(pflag.CommandLine, &Conf.OidcConfigs[i].RootCAFile, "oidcRootCAFile")
+		adjustConfigString(pflag.CommandLine, &Conf.OidcConfigs[i].LoginURLOverride, "loginURLOverride")
+	}
+	if Conf.Saml != nil {
+		adjustPath(Conf.configFolder, &Conf.Saml.IdpMetadataFile)
+		adjustPath(Conf.configFolder, &Conf.Saml.KeyFile)
+		adjustPath(Conf.configFolder, &Conf.Saml.CertFile)
+	}
 
 	// -----------------------------------Handle logging  stuff
 	if Conf.LogMode != "dev" && Conf.LogMode != "json" {
@@ -119,50 +140,107 @@ func Setup() {
 		os.Exit(2)
 	}
 	// ------------------------- Handle Oidc config stuff
-	if (Conf.OidcConfig.ClientID == "") == (Conf.OidcConfig.ClientIDEnv == "") {
-		_, _ = fmt.Fprintf(os.Stderr, "ERROR: One and only one of oidc.clientID and oidc.clientIDEnv must be defined in configuration\n")
-		os.Exit(2)
-	}
-	if Conf.OidcConfig.ClientIDEnv != "" {
-		Conf.OidcConfig.ClientID = os.Getenv(Conf.OidcConfig.ClientIDEnv)
-		if Conf.OidcConfig.ClientID == "" {
-			_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s' environement variable is unset or empty\n", Conf.OidcConfig.ClientIDEnv)
+	if Conf.Saml != nil {
+		if len(Conf.OidcConfigs) > 0 {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: Only one of 'oidc' and 'saml' parameters must be defined\n")
 			os.Exit(2)
 		}
+		setupSamlConfig(Conf.Saml)
+	} else if len(Conf.OidcConfigs) == 0 {
+		missingParameter("oidc")
 	}
-
-	if (Conf.OidcConfig.ClientSecret == "") == (Conf.OidcConfig.ClientSecretEnv == "") {
-		_, _ = fmt.Fprintf(os.Stderr, "ERROR: One and only one of oidc.clientSecret and oidc.clientSecretEnv must be defined in configuration\n")
-		os.Exit(2)
-	}
-	if Conf.OidcConfig.ClientSecretEnv != "" {
-		Conf.OidcConfig.ClientSecret = os.Getenv(Conf.OidcConfig.ClientSecretEnv)
-		if Conf.OidcConfig.ClientSecret == "" {
-			_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s' environement variable is unset or empty\n", Conf.OidcConfig.ClientSecretEnv)
+	providerNames := make(map[string]bool)
+	for i := range Conf.OidcConfigs {
+		oidcConfig := &Conf.OidcConfigs[i]
+		prefix := "oidc"
+		if len(Conf.OidcConfigs) > 1 {
+			prefix = fmt.Sprintf("oidc[%d]", i)
+			if oidcConfig.Name == "" {
+				missingParameter(prefix + ".name")
+			}
+		} else if oidcConfig.Name == "" {
+			oidcConfig.Name = "default"
+		}
+		if !providerNameRegexp.MatchString(oidcConfig.Name) {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s.name' parameter: '%s' is invalid. Only letters, digits, '-' and '_' are allowed\n", prefix, oidcConfig.Name)
+			os.Exit(2)
+		}
+		if providerNames[oidcConfig.Name] {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s.name' parameter: '%s' is used by more than one provider\n", prefix, oidcConfig.Name)
 			os.Exit(2)
 		}
+		providerNames[oidcConfig.Name] = true
+		if oidcConfig.DisplayName == "" {
+			oidcConfig.DisplayName = oidcConfig.Name
+		}
+		setupOidcConfig(oidcConfig, prefix)
 	}
 
-	if Conf.OidcConfig.IssuerURL == "" {
-		missingParameter("oidcConfig.issuerURL")
-	}
-	if Conf.OidcConfig.RedirectURL == "" {
-		missingParameter("oidcConfig.redirectURL")
-	}
-	if Conf.OidcConfig.Scopes == nil {
-		Conf.OidcConfig.Scopes = []string{"profile"}
+	// ----------------------- Bearer token handling
+	if Conf.Bearer.Enabled {
+		// Client IDs are only unique per issuer. So, each provider has its own allowed audiences
+		if len(Conf.Bearer.Audiences) > 0 && len(Conf.OidcConfigs) > 1 {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: 'bearer.audiences' can't be shared by several providers. Use each provider 'tokenValidation.audiences' instead\n")
+			os.Exit(2)
+		}
+		for i := range Conf.OidcConfigs {
+			oidcConfig := &Conf.OidcConfigs[i]
+			if len(Conf.Bearer.Audiences) > 0 {
+				oidcConfig.BearerAudiences = Conf.Bearer.Audiences
+			} else {
+				oidcConfig.BearerAudiences = append([]string{oidcConfig.ClientID}, oidcConfig.TokenValidation.Audiences...)
+			}
+		}
 	}
-
-	if Conf.OidcConfig.LoginURLOverride != "" {
-		myURL, err := url.Parse(Conf.OidcConfig.LoginURLOverride)
-		if err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "ERROR: 'oidcConfig.loginURLOverride' parameter: '%s' is not a valid URL.\n", Conf.OidcConfig.LoginURLOverride)
+	if Conf.Bearer.Introspection.Enabled {
+		if !Conf.Bearer.Enabled {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: 'bearer.introspection.enabled' requires 'bearer.enabled'\n")
 			os.Exit(2)
 		}
-		if myURL.RequestURI() != "/" {
-			_, _ = fmt.Fprintf(os.Stderr, "ERROR: 'oidcConfig.loginURLOverride' parameter: '%s' must be only <scheme>://<host>. Remove '%s'.\n", Conf.OidcConfig.LoginURLOverride, myURL.RequestURI())
+		// Opaque tokens don't tell their issuer. Submitting them to all providers would leak them from one IdP to the others
+		if Conf.Bearer.Introspection.Provider == "" && len(Conf.OidcConfigs) > 1 {
+			missingParameter("bearer.introspection.provider")
+		}
+		var introspectionConfig *OidcConfig
+		for i := range Conf.OidcConfigs {
+			if Conf.Bearer.Introspection.Provider == "" || Conf.OidcConfigs[i].Name == Conf.Bearer.Introspection.Provider {
+				introspectionConfig = &Conf.OidcConfigs[i]
+				Conf.Bearer.Introspection.Provider = introspectionConfig.Name
+				break
+			}
+		}
+		if introspectionConfig == nil {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: 'bearer.introspection.provider' parameter: '%s' is not a provider name\n", Conf.Bearer.Introspection.Provider)
 			os.Exit(2)
 		}
+		if introspectionConfig.ClientSecret == "" && introspectionConfig.ClientAssertionKeyFile == "" {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: 'bearer.introspection.enabled' requires a client secret or a client assertion key on provider '%s', to authenticate on the introspection endpoint\n", introspectionConfig.Name)
+			os.Exit(2)
+		}
+		if Conf.Bearer.Introspection.CacheTTL == "" {
+			Conf.Bearer.Introspection.CacheTTL = "1m"
+		}
+		IntrospectionCacheTTL, err = time.ParseDuration(Conf.Bearer.Introspection.CacheTTL)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s' is not a valid Duration for 'bearer.introspection.cacheTTL' parameter\n", Conf.Bearer.Introspection.CacheTTL)
+			os.Exit(2)
+		}
+		if Conf.Bearer.Introspection.CacheSize <= 0 {
+			Conf.Bearer.Introspection.CacheSize = 1000
+		}
+	}
+
+	// ----------------------- Device authorization
+	if Conf.Device.Enabled {
+		if Conf.Device.RateLimit <= 0 {
+			Conf.Device.RateLimit = 10
+		}
+		if Conf.Device.MaxPending <= 0 {
+			Conf.Device.MaxPending = 1000
+		}
+		for i := range Conf.OidcConfigs {
+			Conf.OidcConfigs[i].DeviceMaxPending = Conf.Device.MaxPending
+		}
 	}
 
 	// ----------------------- Session handling
@@ -176,6 +254,75 @@ func Setup() {
 		_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s' is not a valid Duration for 'sessionConfig.lifetime' parameter\n", Conf.SessionConfig.Lifetime)
 		os.Exit(2)
 	}
+	if Conf.SessionConfig.LoginTimeout == "" {
+		Conf.SessionConfig.LoginTimeout = "10m"
+	}
+	LoginTimeout, err = time.ParseDuration(Conf.SessionConfig.LoginTimeout)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s' is not a valid Duration for 'sessionConfig.loginTimeout' parameter\n", Conf.SessionConfig.LoginTimeout)
+		os.Exit(2)
+	}
+	if Conf.SessionConfig.MaxAuthAge != "" {
+		MaxAuthAge, err = time.ParseDuration(Conf.SessionConfig.MaxAuthAge)
+		if err != nil || MaxAuthAge <= 0 {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s' is not a valid Duration for 'sessionConfig.maxAuthAge' parameter\n", Conf.SessionConfig.MaxAuthAge)
+			os.Exit(2)
+		}
+	}
+	if Conf.SessionConfig.CookieSameSite == "" {
+		Conf.SessionConfig.CookieSameSite = "Lax"
+	}
+	CookieSameSite, ok = sameSiteByString[Conf.SessionConfig.CookieSameSite]
+	if !ok {
+		_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s' is not a valid value for 'sessionConfig.cookieSameSite' parameter. Must be one of 'Lax', 'Strict' or 'None'\n", Conf.SessionConfig.CookieSameSite)
+		os.Exit(2)
+	}
+	if CookieSameSite == http.SameSiteNoneMode && !Conf.SessionConfig.CookieSecure {
+		_, _ = fmt.Fprintf(os.Stderr, "ERROR: 'sessionConfig.cookieSecure' must be set when 'sessionConfig.cookieSameSite' is 'None'\n")
+		os.Exit(2)
+	}
+	// ---------------------- Identity
+	setDefault(&Conf.Claims.Username, "name")
+	setDefault(&Conf.Claims.Email, "email")
+	setDefault(&Conf.Claims.EmailVerified, "email_verified")
+	setDefault(&Conf.Claims.Groups, "groups")
+	for _, header := range []*string{&Conf.IdentityHeaders.Username, &Conf.IdentityHeaders.Email, &Conf.IdentityHeaders.Groups} {
+		if *header != "" {
+			*header = http.CanonicalHeaderKey(*header)
+		}
+	}
+	// ---------------------- Step-up authentication
+	for i := range Conf.OidcConfigs {
+		if len(Conf.StepUp) > 0 && Conf.OidcConfigs[i].Type == ProviderTypeOAuth2 {
+			// No acr, amr or auth_time claims. A rule could never be fulfilled
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: 'stepUp' rules can't be fulfilled by 'oauth2' provider '%s'\n", Conf.OidcConfigs[i].Name)
+			os.Exit(2)
+		}
+	}
+	stepUpPaths := make(map[string]bool)
+	for i := range Conf.StepUp {
+		stepUp := &Conf.StepUp[i]
+		if !strings.HasPrefix(stepUp.Path, "/") {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: 'stepUp[%d].path' parameter: '%s' must be an URL path, starting with '/'\n", i, stepUp.Path)
+			os.Exit(2)
+		}
+		if stepUpPaths[stepUp.Path] {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: 'stepUp[%d].path' parameter: '%s' is defined twice\n", i, stepUp.Path)
+			os.Exit(2)
+		}
+		stepUpPaths[stepUp.Path] = true
+		if len(stepUp.Acr) == 0 && len(stepUp.Amr) == 0 && stepUp.MaxAuthAge == "" {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: 'stepUp[%d]': At least one of 'acr', 'amr' and 'maxAuthAge' must be defined\n", i)
+			os.Exit(2)
+		}
+		if stepUp.MaxAuthAge != "" {
+			stepUp.MaxAuthAgeDuration, err = time.ParseDuration(stepUp.MaxAuthAge)
+			if err != nil || stepUp.MaxAuthAgeDuration <= 0 {
+				_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s' is not a valid Duration for 'stepUp[%d].maxAuthAge' parameter\n", stepUp.MaxAuthAge, i)
+				os.Exit(2)
+			}
+		}
+	}
 	// ---------------------- Users configuration
 	if (Conf.UsersConfigFile == "") && (Conf.UsersConfigMap.ConfigMapName == "") {
 		_, _ = fmt.Fprintf(os.Stderr, "ERROR: One of 'usersConfigFile' and 'usersConfigMapName' parameters must be defined\n")
@@ -186,6 +333,309 @@ func Setup() {
 	}
 }
 
+// Asymmetric algorithms only: A client secret must not be usable to sign ID tokens. See https://www.rfc-editor.org/rfc/rfc8725#section-3.1
+var signingAlgs = map[string]bool{
+	"RS256": true, "RS384": true, "RS512": true,
+	"ES256": true, "ES384": true, "ES512": true,
+	"PS256": true, "PS384": true, "PS512": true,
+}
+
+func setupTokenValidationConfig(tokenValidation *TokenValidationConfig, prefix string) {
+	if tokenValidation.ClockSkew == "" {
+		tokenValidation.ClockSkew = "0s"
+	}
+	var err error
+	tokenValidation.ClockSkewDuration, err = time.ParseDuration(tokenValidation.ClockSkew)
+	if err != nil || tokenValidation.ClockSkewDuration < 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s' is not a valid Duration for '%s.clockSkew' parameter\n", tokenValidation.ClockSkew, prefix)
+		os.Exit(2)
+	}
+	if tokenValidation.ClockSkewDuration > 5*time.Minute {
+		Log.Warnf("%s.clockSkew is more than 5 minutes. Expired tokens will be accepted for long", prefix)
+	}
+	for _, alg := range tokenValidation.SigningAlgs {
+		if !signingAlgs[alg] {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: Invalid %s.signingAlgs value: %s. Must be one of RS256, RS384, RS512, ES256, ES384, ES512, PS256, PS384 or PS512\n", prefix, alg)
+			os.Exit(2)
+		}
+	}
+}
+
+func setupSamlConfig(samlConfig *SamlConfig) {
+	if samlConfig.RootURL == "" {
+		missingParameter("saml.rootURL")
+	}
+	if u, err := url.Parse(samlConfig.RootURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		_, _ = fmt.Fprintf(os.Stderr, "ERROR: 'saml.rootURL' parameter: '%s' is not a valid URL\n", samlConfig.RootURL)
+		os.Exit(2)
+	}
+	samlConfig.RootURL = strings.TrimSuffix(samlConfig.RootURL, "/")
+	setDefault(&samlConfig.EntityID, samlConfig.RootURL+"/dg_saml/metadata")
+	if samlConfig.IdpMetadataFile == "" {
+		missingParameter("saml.idpMetadataFile")
+	}
+	setDefault(&samlConfig.Binding, "redirect")
+	if samlConfig.Binding != "redirect" && samlConfig.Binding != "post" {
+		_, _ = fmt.Fprintf(os.Stderr, "ERROR: Invalid saml.binding value: %s. Must be one of 'redirect' or 'post'\n", samlConfig.Binding)
+		os.Exit(2)
+	}
+	if (samlConfig.KeyFile == "") != (samlConfig.CertFile == "") {
+		_, _ = fmt.Fprintf(os.Stderr, "ERROR: 'saml.keyFile' and 'saml.certFile' must be defined together\n")
+		os.Exit(2)
+	}
+	setDefault(&samlConfig.Attributes.Email, "email")
+	setDefault(&samlConfig.Attributes.Groups, "groups")
+	if Conf.Bearer.Enabled || Conf.Device.Enabled {
+		_, _ = fmt.Fprintf(os.Stderr, "ERROR: 'bearer' and 'device' features are not available with 'saml'\n")
+		os.Exit(2)
+	}
+}
+
+func setupOidcConfig(oidcConfig *OidcConfig, prefix string) {
+	if (oidcConfig.ClientID == "") == (oidcConfig.ClientIDEnv == "") {
+		_, _ = fmt.Fprintf(os.Stderr, "ERROR: One and only one of %s.clientID and %s.clientIDEnv must be defined in configuration\n", prefix, prefix)
+		os.Exit(2)
+	}
+	if oidcConfig.ClientIDEnv != "" {
+		oidcConfig.ClientID = os.Getenv(oidcConfig.ClientIDEnv)
+		if oidcConfig.ClientID == "" {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s' environement variable is unset or empty\n", oidcConfig.ClientIDEnv)
+			os.Exit(2)
+		}
+	}
+
+	// No client secret means a public client.
+	if (oidcConfig.ClientSecret != "") && (oidcConfig.ClientSecretEnv != "") {
+		_, _ = fmt.Fprintf(os.Stderr, "ERROR: Only one of %s.clientSecret and %s.clientSecretEnv must be defined in configuration\n", prefix, prefix)
+		os.Exit(2)
+	}
+	if oidcConfig.ClientSecretEnv != "" {
+		oidcConfig.ClientSecret = os.Getenv(oidcConfig.ClientSecretEnv)
+		if oidcConfig.ClientSecret == "" {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s' environement variable is unset or empty\n", oidcConfig.ClientSecretEnv)
+			os.Exit(2)
+		}
+	}
+
+	if oidcConfig.ClientSecret != "" && oidcConfig.ClientAssertionKeyFile != "" {
+		_, _ = fmt.Fprintf(os.Stderr, "ERROR: Only one of %s.clientSecret and %s.clientAssertionKeyFile must be defined in configuration\n", prefix, prefix)
+		os.Exit(2)
+	}
+
+	if oidcConfig.IssuerURL == "" {
+		missingParameter(prefix + ".issuerURL")
+	}
+	if oidcConfig.RedirectURL == "" {
+		missingParameter(prefix + ".redirectURL")
+	}
+	if oidcConfig.PostLogoutRedirectURL != "" {
+		if _, err := url.Parse(oidcConfig.PostLogoutRedirectURL); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s.postLogoutRedirectURL' parameter: '%s' is not a valid URL.\n", prefix, oidcConfig.PostLogoutRedirectURL)
+			os.Exit(2)
+		}
+	}
+	if oidcConfig.UserInfoPrecedence == "" {
+		oidcConfig.UserInfoPrecedence = "idToken"
+	}
+	if oidcConfig.UserInfoPrecedence != "idToken" && oidcConfig.UserInfoPrecedence != "userInfo" {
+		_, _ = fmt.Fprintf(os.Stderr, "ERROR: Invalid %s.userInfoPrecedence value: %s. Must be one of 'idToken' or 'userInfo'\n", prefix, oidcConfig.UserInfoPrecedence)
+		os.Exit(2)
+	}
+	if oidcConfig.ResponseMode == "" {
+		oidcConfig.ResponseMode = "query"
+	}
+	if oidcConfig.ResponseMode != "query" && oidcConfig.ResponseMode != "form_post" {
+		_, _ = fmt.Fprintf(os.Stderr, "ERROR: Invalid %s.responseMode value: %s. Must be one of 'query' or 'form_post'\n", prefix, oidcConfig.ResponseMode)
+		os.Exit(2)
+	}
+	if oidcConfig.PKCE == nil {
+		pkce := true
+		oidcConfig.PKCE = &pkce
+	}
+	if oidcConfig.ClientSecret == "" && oidcConfig.ClientAssertionKeyFile == "" && !*oidcConfig.PKCE {
+		Log.Warnf("%s.pkce is disabled for a public client (No client secret). This is not recommended", prefix)
+	}
+	if oidcConfig.Scopes == nil && oidcConfig.Type != ProviderTypeOAuth2 {
+		oidcConfig.Scopes = []string{"profile"}
+	}
+	if oidcConfig.MetadataRefreshInterval == "" {
+		oidcConfig.MetadataRefreshInterval = "1h"
+	}
+	var err error
+	oidcConfig.MetadataRefreshPeriod, err = time.ParseDuration(oidcConfig.MetadataRefreshInterval)
+	if err != nil || oidcConfig.MetadataRefreshPeriod < 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s' is not a valid Duration for '%s.metadataRefreshInterval' parameter\n", oidcConfig.MetadataRefreshInterval, prefix)
+		os.Exit(2)
+	}
+
+	setupTransportConfig(&oidcConfig.Transport, prefix+".transport")
+
+	if oidcConfig.Type == "" {
+		oidcConfig.Type = ProviderTypeOIDC
+	}
+	switch oidcConfig.Type {
+	case ProviderTypeOIDC:
+		if oidcConfig.Endpoints != nil {
+			setupEndpointsConfig(oidcConfig.Endpoints, prefix+".endpoints", oidcConfig.UseUserInfo, true)
+		}
+	case ProviderTypeOAuth2:
+		// No discovery for plain OAuth2 servers
+		if oidcConfig.Endpoints == nil {
+			missingParameter(prefix + ".endpoints")
+		}
+		if oidcConfig.UseUserInfo {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s.useUserInfo' can't be set for an 'oauth2' provider. Use '%s.oauth2.userURL'\n", prefix, prefix)
+			os.Exit(2)
+		}
+		if !reflect.DeepEqual(oidcConfig.TokenValidation, TokenValidationConfig{}) {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s.tokenValidation' can't be set for an 'oauth2' provider, as it issues no ID token\n", prefix)
+			os.Exit(2)
+		}
+		setupEndpointsConfig(oidcConfig.Endpoints, prefix+".endpoints", false, false)
+		setupOAuth2Config(&oidcConfig.OAuth2, prefix+".oauth2")
+	default:
+		_, _ = fmt.Fprintf(os.Stderr, "ERROR: Invalid %s.type value: %s. Must be one of 'oidc' or 'oauth2'\n", prefix, oidcConfig.Type)
+		os.Exit(2)
+	}
+
+	setupTokenValidationConfig(&oidcConfig.TokenValidation, prefix+".tokenValidation")
+
+	if err := checkAuthParams(oidcConfig, prefix); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(2)
+	}
+
+	if oidcConfig.LoginURLOverride != "" {
+		myURL, err := url.Parse(oidcConfig.LoginURLOverride)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s.loginURLOverride' parameter: '%s' is not a valid URL.\n", prefix, oidcConfig.LoginURLOverride)
+			os.Exit(2)
+		}
+		if myURL.RequestURI() != "/" {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s.loginURLOverride' parameter: '%s' must be only <scheme>://<host>. Remove '%s'.\n", prefix, oidcConfig.LoginURLOverride, myURL.RequestURI())
+			os.Exit(2)
+		}
+	}
+}
+
+// Authorization request parameters which can't be set by configuration, as they are managed by dexgate.
+// 'prompt', 'max_age' and 'acr_values' are requested by the step-up rules only.
+var reservedAuthParams = map[string]bool{
+	"response_type":         true,
+	"response_mode":         true,
+	"client_id":             true,
+	"redirect_uri":          true,
+	"scope":                 true,
+	"state":                 true,
+	"nonce":                 true,
+	"code_challenge":        true,
+	"code_challenge_method": true,
+	"access_type":           true,
+	"prompt":                true,
+	"max_age":               true,
+	"acr_values":            true,
+	"request":               true,
+	"request_uri":           true,
+}
+
+// checkAuthParams reject the configured authorization request parameters which are managed by dexgate
+func checkAuthParams(oidcConfig *OidcConfig, prefix string) error {
+	for name := range oidcConfig.ExtraAuthParams {
+		if reservedAuthParams[name] {
+			return fmt.Errorf("'%s.extraAuthParams' parameter: '%s' is managed by dexgate and can't be set", prefix, name)
+		}
+	}
+	for _, name := range oidcConfig.AuthParamsPassthrough {
+		if reservedAuthParams[name] {
+			return fmt.Errorf("'%s.authParamsPassthrough' parameter: '%s' is managed by dexgate and can't be forwarded", prefix, name)
+		}
+	}
+	return nil
+}
+
+func setupOAuth2Config(oauth2Config *OAuth2Config, prefix string) {
+	if oauth2Config.UserURL == "" {
+		missingParameter(prefix + ".userURL")
+	}
+	for name, value := range map[string]string{"userURL": oauth2Config.UserURL, "groupsURL": oauth2Config.GroupsURL} {
+		if value == "" {
+			continue
+		}
+		if u, err := url.Parse(value); err != nil || u.Host == "" {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s.%s' parameter: '%s' is not a valid URL.\n", prefix, name, value)
+			os.Exit(2)
+		}
+	}
+	setDefault(&oauth2Config.SubjectField, "id")
+	if len(oauth2Config.GroupFields) == 0 {
+		oauth2Config.GroupFields = []string{"login"}
+	}
+}
+
+func setupEndpointsConfig(endpoints *EndpointsConfig, prefix string, useUserInfo bool, requireJWKS bool) {
+	for _, endpoint := range []struct {
+		name      string
+		value     string
+		mandatory bool
+	}{
+		{"authorization", endpoints.Authorization, true},
+		{"token", endpoints.Token, true},
+		{"userinfo", endpoints.UserInfo, useUserInfo},
+		{"jwks", endpoints.JWKS, requireJWKS},
+	} {
+		if endpoint.value == "" {
+			if endpoint.mandatory {
+				missingParameter(prefix + "." + endpoint.name)
+			}
+			continue
+		}
+		if u, err := url.Parse(endpoint.value); err != nil || u.Host == "" {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s.%s' parameter: '%s' is not a valid URL.\n", prefix, endpoint.name, endpoint.value)
+			os.Exit(2)
+		}
+	}
+	if len(endpoints.SigningAlgs) == 0 {
+		// The default, as defined by OIDC discovery specification
+		endpoints.SigningAlgs = []string{"RS256"}
+	}
+}
+
+func setupTransportConfig(transport *TransportConfig, prefix string) {
+	if (transport.ClientCertFile == "") != (transport.ClientKeyFile == "") {
+		_, _ = fmt.Fprintf(os.Stderr, "ERROR: %s.clientCertFile and %s.clientKeyFile must be defined together\n", prefix, prefix)
+		os.Exit(2)
+	}
+	if transport.ProxyURL != "" {
+		proxy, err := url.Parse(transport.ProxyURL)
+		if err != nil || proxy.Host == "" {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s.proxyURL' parameter: '%s' is not a valid URL.\n", prefix, transport.ProxyURL)
+			os.Exit(2)
+		}
+		transport.Proxy = proxy
+	}
+	transport.DialDuration = parseTimeout(transport.DialTimeout, "30s", prefix+".dialTimeout")
+	transport.TLSDuration = parseTimeout(transport.TLSTimeout, "10s", prefix+".tlsTimeout")
+	transport.ResponseDuration = parseTimeout(transport.ResponseTimeout, "30s", prefix+".responseTimeout")
+}
+
+func parseTimeout(value string, defaultValue string, param string) time.Duration {
+	if value == "" {
+		value = defaultValue
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s' is not a valid Duration for '%s' parameter\n", value, param)
+		os.Exit(2)
+	}
+	return duration
+}
+
+func setDefault(value *string, defaultValue string) {
+	if *value == "" {
+		*value = defaultValue
+	}
+}
+
 func missingParameter(param string) {
 	_, _ = fmt.Fprintf(os.Stderr, "ERROR: '%s' parameter must be defined in config file\n", param)
 	os.Exit(2)
@@ -0,0 +1,37 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckAuthParams(t *testing.T) {
+	tests := []struct {
+		name        string
+		extra       map[string]string
+		passthrough []string
+		error       string // Empty if the configuration is valid
+	}{
+		{"allowed parameters", map[string]string{"kc_idp_hint": "corp", "ui_locales": "fr"}, []string{"login_hint", "domain_hint"}, ""},
+		{"no parameters", nil, nil, ""},
+		{"extra nonce", map[string]string{"nonce": "x"}, nil, "'oidc.extraAuthParams' parameter: 'nonce'"},
+		{"extra prompt", map[string]string{"ui_locales": "fr", "prompt": "login"}, nil, "'oidc.extraAuthParams' parameter: 'prompt'"},
+		{"extra response mode", map[string]string{"response_mode": "fragment"}, nil, "'oidc.extraAuthParams' parameter: 'response_mode'"},
+		{"passthrough acr_values", nil, []string{"login_hint", "acr_values"}, "'oidc.authParamsPassthrough' parameter: 'acr_values'"},
+		{"passthrough max_age", nil, []string{"max_age"}, "'oidc.authParamsPassthrough' parameter: 'max_age'"},
+		{"passthrough redirect_uri", nil, []string{"redirect_uri"}, "'oidc.authParamsPassthrough' parameter: 'redirect_uri'"},
+		{"passthrough request object", nil, []string{"request_uri"}, "'oidc.authParamsPassthrough' parameter: 'request_uri'"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkAuthParams(&OidcConfig{ExtraAuthParams: test.extra, AuthParamsPassthrough: test.passthrough}, "oidc")
+			if test.error == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("expected error '%s', got %v", test.error, err)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package director
 
 import (
 	"dexgate/internal/config"
+	"dexgate/internal/identity"
 	"net/http"
 	"net/url"
 	"strings"
@@ -68,6 +69,7 @@ func NewDirector(targetURL *url.URL) func(req *http.Request) {
 		} else {
 			req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
 		}
+		setIdentityHeaders(req)
 		if _, ok := req.Header["User-Agent"]; !ok {
 			// explicitly disable User-Agent so it's not set to default value
 			req.Header.Set("User-Agent", "")
@@ -75,3 +77,37 @@ func NewDirector(targetURL *url.URL) func(req *http.Request) {
 		log.Debugf("%s %s -> %s (Reverse proxy)", req.Method, oldUrl.String(), req.URL.String())
 	}
 }
+
+// IdentityHeadersEnabled tell if at least one identity header is configured
+func IdentityHeadersEnabled() bool {
+	h := config.Conf.IdentityHeaders
+	return h.Username != "" || h.Email != "" || h.Groups != ""
+}
+
+// setIdentityHeaders provide the user identity to the target application, if attached to the request.
+// Headers sent by the client with the same names are always removed, as they can't be trusted.
+// For the same reason, the email is provided only if verified by the IdP.
+func setIdentityHeaders(req *http.Request) {
+	if !IdentityHeadersEnabled() {
+		return
+	}
+	h := config.Conf.IdentityHeaders
+	for _, name := range []string{h.Username, h.Email, h.Groups} {
+		if name != "" {
+			req.Header.Del(name)
+		}
+	}
+	id := identity.FromContext(req.Context())
+	if id == nil {
+		return
+	}
+	if h.Username != "" && id.Username != "" {
+		req.Header.Set(h.Username, id.Username)
+	}
+	if h.Email != "" && id.Email != "" && id.EmailVerified {
+		req.Header.Set(h.Email, id.Email)
+	}
+	if h.Groups != "" && len(id.Groups) > 0 {
+		req.Header.Set(h.Groups, strings.Join(id.Groups, ","))
+	}
+}
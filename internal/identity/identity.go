@@ -0,0 +1,159 @@
+package identity
+
+import (
+	"context"
+	"dexgate/internal/config"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Identity is the user identity, as extracted from the claims
+type Identity struct {
+	Issuer        string   `yaml:"iss"`
+	Username      string   `yaml:"username"`
+	Email         string   `yaml:"email"`
+	EmailVerified bool     `yaml:"email_verified"`
+	Groups        []string `yaml:"groups"`
+}
+
+// Mapping define the claim path of each identity field
+type Mapping struct {
+	username      string
+	email         string
+	emailVerified string
+	groups        string
+}
+
+func NewMapping(claimsConfig config.ClaimsConfig) *Mapping {
+	return &Mapping{
+		username:      claimsConfig.Username,
+		email:         claimsConfig.Email,
+		emailVerified: claimsConfig.EmailVerified,
+		groups:        claimsConfig.Groups,
+	}
+}
+
+// FromClaims extract the user identity from a JSON encoded claims set
+func (m *Mapping) FromClaims(claimsJson string) (*Identity, error) {
+	var claims map[string]interface{}
+	if err := json.Unmarshal([]byte(claimsJson), &claims); err != nil {
+		return nil, err
+	}
+	return m.FromMap(claims)
+}
+
+// FromMap extract the user identity from a decoded claims set
+func (m *Mapping) FromMap(claims map[string]interface{}) (*Identity, error) {
+	id := &Identity{}
+	id.Issuer, _ = claims["iss"].(string)
+	var err error
+	if id.Username, err = lookupString(claims, m.username); err != nil {
+		return nil, err
+	}
+	if id.Email, err = lookupString(claims, m.email); err != nil {
+		return nil, err
+	}
+	if id.Groups, err = lookupStrings(claims, m.groups); err != nil {
+		return nil, err
+	}
+	if value, ok := Lookup(claims, m.emailVerified); ok {
+		switch v := value.(type) {
+		case bool:
+			id.EmailVerified = v
+		case string:
+			// Some OIDC servers provide it as a string
+			id.EmailVerified, _ = strconv.ParseBool(v)
+		}
+	}
+	return id, nil
+}
+
+// ToClaims store the identity in a claims set, under the mapped paths, for FromClaims to find it back.
+// Paths are stored as plain claim names, which take precedence on nested claims in Lookup.
+// Groups are always set, so that groups found elsewhere in the claims set are superseded.
+func (m *Mapping) ToClaims(id *Identity, claims map[string]interface{}) {
+	if id.Username != "" {
+		claims[m.username] = id.Username
+	}
+	if id.Email != "" {
+		claims[m.email] = id.Email
+		claims[m.emailVerified] = id.EmailVerified
+	}
+	groups := id.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	claims[m.groups] = groups
+}
+
+// GroupsPath return the claim path of the groups
+func (m *Mapping) GroupsPath() string {
+	return m.groups
+}
+
+// Lookup return the value of a claim. The path may be dotted, to reach a nested claim (i.e. 'realm_access.roles').
+// As claim names may include dots (i.e. 'https://mycompany.com/groups'), the longest matching name is tried first at each level.
+func Lookup(claims map[string]interface{}, path string) (interface{}, bool) {
+	if value, ok := claims[path]; ok {
+		return value, true
+	}
+	for i := strings.LastIndex(path, "."); i > 0; i = strings.LastIndex(path[:i], ".") {
+		if nested, ok := claims[path[:i]].(map[string]interface{}); ok {
+			if value, ok := Lookup(nested, path[i+1:]); ok {
+				return value, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// lookupString return a single string claim. If the claim is an array, its first element is retained
+func lookupString(claims map[string]interface{}, path string) (string, error) {
+	values, err := lookupStrings(claims, path)
+	if err != nil || len(values) == 0 {
+		return "", err
+	}
+	return values[0], nil
+}
+
+// lookupStrings return a claim which may be a string or an array of strings
+func lookupStrings(claims map[string]interface{}, path string) ([]string, error) {
+	value, ok := Lookup(claims, path)
+	if !ok || value == nil {
+		return nil, nil
+	}
+	switch v := value.(type) {
+	case string:
+		return []string{v}, nil
+	case []string:
+		// Set by ToClaims
+		return v, nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("claim '%s' must be a string or an array of strings", path)
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("claim '%s' must be a string or an array of strings", path)
+	}
+}
+
+type contextKey struct{}
+
+// NewContext return a context carrying the identity, for the request to the target application
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext return the identity stored in the context. nil if none.
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(contextKey{}).(*Identity)
+	return id
+}
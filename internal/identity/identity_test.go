@@ -0,0 +1,118 @@
+package identity
+
+import (
+	"dexgate/internal/config"
+	"reflect"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	claims := map[string]interface{}{
+		"name":                          "john",
+		"realm_access":                  map[string]interface{}{"roles": []interface{}{"admin"}},
+		"https://mycompany.com/groups":  []interface{}{"dev"},
+		"https://mycompany.com":         map[string]interface{}{"groups": "shadowed"},
+		"resource_access":               map[string]interface{}{"app.v2": map[string]interface{}{"roles": "reader"}},
+		"resource_access.app.v2.roles":  nil,
+		"https://other.com/custom.attr": map[string]interface{}{"x": "y"},
+	}
+	tests := []struct {
+		path  string
+		value interface{}
+		found bool
+	}{
+		{"name", "john", true},
+		{"realm_access.roles", []interface{}{"admin"}, true},
+		{"realm_access.missing", nil, false},
+		{"realm_access.roles.x", nil, false},
+		// A claim name including dots is found as is, before any nested claim
+		{"https://mycompany.com/groups", []interface{}{"dev"}, true},
+		{"resource_access.app.v2.roles", nil, true},
+		{"https://other.com/custom.attr.x", "y", true},
+		{"missing", nil, false},
+	}
+	for _, test := range tests {
+		value, found := Lookup(claims, test.path)
+		if found != test.found || !reflect.DeepEqual(value, test.value) {
+			t.Errorf("Lookup(%q): expected %v %v, got %v %v", test.path, test.value, test.found, value, found)
+		}
+	}
+}
+
+func TestFromClaims(t *testing.T) {
+	mapping := NewMapping(config.ClaimsConfig{Username: "preferred_username", Email: "mail", EmailVerified: "mail_verified", Groups: "realm_access.roles"})
+	tests := []struct {
+		name     string
+		claims   string
+		identity *Identity
+		fails    bool
+	}{
+		{
+			name:     "mapped claims",
+			claims:   `{"iss": "https://idp", "preferred_username": "john", "name": "John", "mail": "john@example.com", "mail_verified": true, "realm_access": {"roles": ["admin", "dev"]}}`,
+			identity: &Identity{Issuer: "https://idp", Username: "john", Email: "john@example.com", EmailVerified: true, Groups: []string{"admin", "dev"}},
+		},
+		{
+			name:     "arrays and strings",
+			claims:   `{"preferred_username": ["john", "jdoe"], "mail_verified": "true", "realm_access": {"roles": "admin"}}`,
+			identity: &Identity{Username: "john", EmailVerified: true, Groups: []string{"admin"}},
+		},
+		{
+			name:     "default claims are ignored",
+			claims:   `{"name": "John", "email": "john@example.com", "email_verified": true, "groups": ["dev"]}`,
+			identity: &Identity{},
+		},
+		{
+			name:   "invalid groups",
+			claims: `{"realm_access": {"roles": [1, 2]}}`,
+			fails:  true,
+		},
+		{
+			name:   "invalid username",
+			claims: `{"preferred_username": {"first": "john"}}`,
+			fails:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			id, err := mapping.FromClaims(test.claims)
+			if test.fails {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", id)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(id, test.identity) {
+				t.Errorf("expected %+v, got %+v", test.identity, id)
+			}
+		})
+	}
+}
+
+func TestToClaims(t *testing.T) {
+	for _, claimsConfig := range []config.ClaimsConfig{
+		{Username: "name", Email: "email", EmailVerified: "email_verified", Groups: "groups"},
+		{Username: "preferred_username", Email: "https://mycompany.com/mail", EmailVerified: "mail.verified", Groups: "realm_access.roles"},
+	} {
+		mapping := NewMapping(claimsConfig)
+		id := &Identity{Username: "john", Email: "john@example.com", EmailVerified: true, Groups: []string{"dev"}}
+		// Groups found elsewhere in the claims set are superseded
+		claims := map[string]interface{}{"realm_access": map[string]interface{}{"roles": []interface{}{"admin"}}}
+		mapping.ToClaims(id, claims)
+		got, err := mapping.FromMap(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, id) {
+			t.Errorf("%+v: expected %+v, got %+v", claimsConfig, id, got)
+		}
+		// No groups is stored as an empty list
+		mapping.ToClaims(&Identity{}, claims)
+		if got, _ = mapping.FromMap(claims); len(got.Groups) != 0 || got.Username != "john" {
+			t.Errorf("%+v: unexpected identity %+v", claimsConfig, got)
+		}
+	}
+}
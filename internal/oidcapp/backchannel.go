@@ -0,0 +1,102 @@
+package oidcapp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// See https://openid.net/specs/openid-connect-backchannel-1_0.html#LogoutToken
+const backChannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// Logout tokens issued before this delay are rejected. Also the retention period of the jti, for replay detection.
+const logoutTokenMaxAge = 5 * time.Minute
+
+// Tolerance for logout tokens issued 'in the future', due to clock skew.
+const logoutTokenLeeway = 1 * time.Minute
+
+// LogoutToken is the result of a successful logout token validation. At least one of Subject and Sid is defined.
+type LogoutToken struct {
+	Subject string
+	Sid     string
+}
+
+// VerifyLogoutToken validate a logout token, as sent by the OIDC server on back-channel logout.
+func (app *OidcApp) VerifyLogoutToken(ctx context.Context, rawLogoutToken string) (*LogoutToken, error) {
+	d, err := app.current()
+	if err != nil {
+		return nil, err
+	}
+	token, err := d.logoutVerifier.Verify(ctx, rawLogoutToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify logout token: %v", err)
+	}
+	var claims struct {
+		Sid    string                     `json:"sid"`
+		Jti    string                     `json:"jti"`
+		Exp    float64                    `json:"exp"`
+		Nonce  *string                    `json:"nonce"`
+		Events map[string]json.RawMessage `json:"events"`
+	}
+	if err := token.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("error decoding logout token claims: %v", err)
+	}
+	if _, ok := claims.Events[backChannelLogoutEvent]; !ok {
+		return nil, fmt.Errorf("logout token does not contain the '%s' event", backChannelLogoutEvent)
+	}
+	if claims.Nonce != nil {
+		return nil, fmt.Errorf("logout token must not contain a nonce")
+	}
+	if token.Subject == "" && claims.Sid == "" {
+		return nil, fmt.Errorf("logout token must contain a sub or a sid claim")
+	}
+	now := time.Now()
+	skew := app.config.TokenValidation.ClockSkewDuration
+	if token.IssuedAt.IsZero() {
+		return nil, fmt.Errorf("logout token does not contain an iat claim")
+	}
+	if now.Sub(token.IssuedAt) > logoutTokenMaxAge+skew || token.IssuedAt.After(now.Add(logoutTokenLeeway+skew)) {
+		return nil, fmt.Errorf("logout token issued at %s is out of the acceptable time window", token.IssuedAt.String())
+	}
+	if claims.Exp != 0 && now.Add(-skew).After(time.Unix(int64(claims.Exp), 0)) {
+		return nil, fmt.Errorf("logout token is expired")
+	}
+	if claims.Jti == "" {
+		return nil, fmt.Errorf("logout token does not contain a jti claim")
+	}
+	if !app.logoutJtis.add(claims.Jti, token.IssuedAt.Add(logoutTokenMaxAge)) {
+		return nil, fmt.Errorf("logout token '%s' has already been used", claims.Jti)
+	}
+	return &LogoutToken{
+		Subject: token.Subject,
+		Sid:     claims.Sid,
+	}, nil
+}
+
+// jtiCache keep track of the already used logout tokens, up to their expiry.
+type jtiCache struct {
+	mutex   sync.Mutex
+	entries map[string]time.Time
+}
+
+// add register the jti. Return false if already present.
+func (c *jtiCache) add(jti string, expiry time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for key, exp := range c.entries {
+		if now.After(exp) {
+			delete(c.entries, key)
+		}
+	}
+	if _, ok := c.entries[jti]; ok {
+		return false
+	}
+	c.entries[jti] = expiry
+	return true
+}
@@ -0,0 +1,67 @@
+package oidcapp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// VerifyBearerToken validate a JWT provided as bearer token by an API client. Its audience must contain one of the provider bearer audiences.
+// If authorized parties are configured, or required, the 'azp' claim (Or 'client_id', as in RFC 9068 access tokens) is checked too.
+// Return the token claims.
+func (app *OidcApp) VerifyBearerToken(ctx context.Context, rawToken string) (string, error) {
+	d, err := app.current()
+	if err != nil {
+		return "", err
+	}
+	token, err := d.bearerVerifier.Verify(ctx, rawToken)
+	if err != nil {
+		return "", fmt.Errorf("failed to verify bearer token: %v", err)
+	}
+	if err := app.checkExpiry(token); err != nil {
+		return "", fmt.Errorf("failed to verify bearer token: %v", err)
+	}
+	if !ContainsOneOf(token.Audience, app.BearerAudiences()) {
+		return "", fmt.Errorf("bearer token audience %q does not match any of the allowed ones", token.Audience)
+	}
+	var claims json.RawMessage
+	if err := token.Claims(&claims); err != nil {
+		return "", fmt.Errorf("error decoding bearer token claims: %v", err)
+	}
+	var client struct {
+		Azp      string `json:"azp"`
+		ClientID string `json:"client_id"`
+	}
+	if err := json.Unmarshal(claims, &client); err != nil {
+		return "", fmt.Errorf("error decoding bearer token claims: %v", err)
+	}
+	if client.Azp == "" {
+		client.Azp = client.ClientID
+	}
+	if err := app.CheckBearerAuthorizedParty(client.Azp); err != nil {
+		return "", fmt.Errorf("bearer token %v", err)
+	}
+	return string(claims), nil
+}
+
+// CheckBearerAuthorizedParty check the client a bearer token was issued to ('azp' claim, or 'client_id'), if authorized parties are configured, or required.
+// API clients usually have their own client ID. So, unlike for ID tokens, it is not checked by default.
+func (app *OidcApp) CheckBearerAuthorizedParty(azp string) error {
+	tokenValidation := &app.config.TokenValidation
+	if len(tokenValidation.AuthorizedParties) == 0 && !tokenValidation.RequireAuthorizedParty {
+		return nil
+	}
+	return checkAuthorizedParty(azp, tokenValidation.RequireAuthorizedParty, app.authorizedParties())
+}
+
+// ContainsOneOf tell if at least one of the values is an expected one. Empty values never match, as an absent claim must not.
+func ContainsOneOf(values []string, expected []string) bool {
+	for _, value := range values {
+		for _, e := range expected {
+			if value != "" && value == e {
+				return true
+			}
+		}
+	}
+	return false
+}
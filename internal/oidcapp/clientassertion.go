@@ -0,0 +1,237 @@
+package oidcapp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"dexgate/internal/config"
+	"dexgate/pkg/configwatcher"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"gopkg.in/square/go-jose.v2"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// See https://www.rfc-editor.org/rfc/rfc7523#section-2.2
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// Client assertion validity. Kept short, as a new one is built for each request
+const clientAssertionLifetime = 2 * time.Minute
+
+// How often the key file is checked for rotation
+const clientAssertionKeyPollInterval = 30 * time.Second
+
+// How long the previous key is still published after rotation, for OIDC servers caching our JWKS
+const clientAssertionKeyGracePeriod = 24 * time.Hour
+
+// clientAssertion authenticate dexgate on the OIDC server with a signed JWT (private_key_jwt), instead of a client secret.
+// See https://openid.net/specs/openid-connect-core-1_0.html#ClientAuthentication
+type clientAssertion struct {
+	clientID       string
+	keyID          string // From configuration. If empty, the key thumbprint is used
+	mutex          sync.RWMutex
+	key            *jose.JSONWebKey // Private key
+	previous       *jose.JSONWebKey // Key replaced by the last rotation. Published up to previousExpiry
+	previousExpiry time.Time
+	watcher        configwatcher.ConfigWatcher
+}
+
+func newClientAssertion(oidcConfig *config.OidcConfig) (*clientAssertion, error) {
+	ca := &clientAssertion{
+		clientID: oidcConfig.ClientID,
+		keyID:    oidcConfig.ClientAssertionKeyID,
+	}
+	watcher, err := configwatcher.NewPollingFileWatcher(oidcConfig.ClientAssertionKeyFile, clientAssertionKeyPollInterval, config.Log)
+	if err != nil {
+		return nil, err
+	}
+	data, err := watcher.Get()
+	if err != nil {
+		return nil, err
+	}
+	if err := ca.load([]byte(data)); err != nil {
+		return nil, fmt.Errorf("unable to load client assertion key '%s': %v", oidcConfig.ClientAssertionKeyFile, err)
+	}
+	config.Log.Infof("Provider '%s': client assertion key '%s' loaded (kid: %s)", oidcConfig.Name, oidcConfig.ClientAssertionKeyFile, ca.currentKey().KeyID)
+	err = watcher.Watch(func(data string) {
+		if err := ca.load([]byte(data)); err != nil {
+			config.Log.Errorf("Provider '%s': Error on reloading client assertion key '%s': %v. Keep old version", oidcConfig.Name, oidcConfig.ClientAssertionKeyFile, err)
+		} else {
+			config.Log.Infof("Provider '%s': client assertion key '%s' reloaded (kid: %s)", oidcConfig.Name, oidcConfig.ClientAssertionKeyFile, ca.currentKey().KeyID)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	ca.watcher = watcher
+	return ca, nil
+}
+
+// load parse a PEM encoded RSA or EC private key (PKCS#8, PKCS#1 or SEC 1)
+func (ca *clientAssertion) load(data []byte) error {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("no PEM data found")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return fmt.Errorf("unsupported PEM block type '%s'", block.Type)
+	}
+	if err != nil {
+		return err
+	}
+	jwk := &jose.JSONWebKey{Key: key, KeyID: ca.keyID, Use: "sig"}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		jwk.Algorithm = string(jose.RS256)
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			jwk.Algorithm = string(jose.ES256)
+		case elliptic.P384():
+			jwk.Algorithm = string(jose.ES384)
+		case elliptic.P521():
+			jwk.Algorithm = string(jose.ES512)
+		default:
+			return fmt.Errorf("unsupported EC curve '%s'", k.Curve.Params().Name)
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T. Must be RSA or EC", key)
+	}
+	if jwk.KeyID == "" {
+		thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return fmt.Errorf("unable to compute key thumbprint: %v", err)
+		}
+		jwk.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+	}
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	// With a configured key ID, both keys would have the same one. The OIDC server could not tell them apart
+	if ca.key != nil && ca.key.KeyID != jwk.KeyID {
+		ca.previous = ca.key
+		ca.previousExpiry = time.Now().Add(clientAssertionKeyGracePeriod)
+	}
+	ca.key = jwk
+	return nil
+}
+
+func (ca *clientAssertion) currentKey() *jose.JSONWebKey {
+	ca.mutex.RLock()
+	defer ca.mutex.RUnlock()
+	return ca.key
+}
+
+// publicKeys return the public part of the key, and of the previous one during the grace period, to be published as JWKS
+func (ca *clientAssertion) publicKeys() []jose.JSONWebKey {
+	ca.mutex.RLock()
+	defer ca.mutex.RUnlock()
+	keys := []jose.JSONWebKey{ca.key.Public()}
+	if ca.previous != nil && time.Now().Before(ca.previousExpiry) {
+		keys = append(keys, ca.previous.Public())
+	}
+	return keys
+}
+
+// sign build a client assertion for the given audience (The endpoint the request is sent to)
+func (ca *clientAssertion) sign(audience string) (string, error) {
+	key := ca.currentKey()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.SignatureAlgorithm(key.Algorithm), Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return "", err
+	}
+	jti, err := randomString(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss": ca.clientID,
+		"sub": ca.clientID,
+		"aud": audience,
+		"jti": jti,
+		"iat": now.Unix(),
+		"exp": now.Add(clientAssertionLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	jws, err := signer.Sign(claims)
+	if err != nil {
+		return "", err
+	}
+	return jws.CompactSerialize()
+}
+
+// clientAssertionTransport add a client assertion to all form POST requests. To be used only for requests to the OIDC server
+// endpoints requiring client authentication (Token, introspection, ...).
+type clientAssertionTransport struct {
+	base      http.RoundTripper
+	assertion *clientAssertion
+}
+
+func (t *clientAssertionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPost || !strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") || req.Body == nil {
+		return t.base.RoundTrip(req)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	audience := *req.URL
+	audience.RawQuery = ""
+	assertion, err := t.assertion.sign(audience.String())
+	if err != nil {
+		return nil, fmt.Errorf("unable to build client assertion: %v", err)
+	}
+	form.Set("client_assertion_type", clientAssertionType)
+	form.Set("client_assertion", assertion)
+	encoded := form.Encode()
+	// RoundTripper must not modify the request
+	req = req.Clone(req.Context())
+	req.Body = ioutil.NopCloser(bytes.NewReader([]byte(encoded)))
+	req.ContentLength = int64(len(encoded))
+	req.GetBody = nil
+	return t.base.RoundTrip(req)
+}
+
+// PublicJWKS return the public keys used for client assertion by the given providers, as a JWKS document
+func PublicJWKS(providers *Providers) jose.JSONWebKeySet {
+	jwks := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{}}
+	seen := make(map[string]bool)
+	for _, app := range providers.List() {
+		if app.assertion == nil {
+			continue
+		}
+		for _, key := range app.assertion.publicKeys() {
+			if !seen[key.KeyID] {
+				seen[key.KeyID] = true
+				jwks.Keys = append(jwks.Keys, key)
+			}
+		}
+	}
+	return jwks
+}
@@ -0,0 +1,153 @@
+package oidcapp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"gopkg.in/square/go-jose.v2"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func pemKey(blockType string, der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
+
+func TestClientAssertionClaims(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec1, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		pem   []byte
+		keyID string
+		alg   string
+	}{
+		{"RSA PKCS#1", pemKey("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)), "", "RS256"},
+		{"RSA PKCS#8", pemKey("PRIVATE KEY", pkcs8), "key-1", "RS256"},
+		{"EC P-384", pemKey("EC PRIVATE KEY", sec1), "", "ES384"},
+	}
+	const audience = "https://idp.example.com/token"
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ca := &clientAssertion{clientID: "dexgate", keyID: test.keyID}
+			if err := ca.load(test.pem); err != nil {
+				t.Fatal(err)
+			}
+			public := ca.publicKeys()[0]
+			if public.KeyID == "" || (test.keyID != "" && public.KeyID != test.keyID) {
+				t.Errorf("unexpected key ID '%s'", public.KeyID)
+			}
+			assertion, err := ca.sign(audience)
+			if err != nil {
+				t.Fatal(err)
+			}
+			jws, err := jose.ParseSigned(assertion)
+			if err != nil {
+				t.Fatal(err)
+			}
+			header := jws.Signatures[0].Header
+			if header.Algorithm != test.alg || header.KeyID != public.KeyID || header.ExtraHeaders["typ"] != "JWT" {
+				t.Errorf("unexpected header: %+v", header)
+			}
+			payload, err := jws.Verify(public)
+			if err != nil {
+				t.Fatalf("the assertion is not verified by the published key: %v", err)
+			}
+			var claims struct {
+				Iss string `json:"iss"`
+				Sub string `json:"sub"`
+				Aud string `json:"aud"`
+				Jti string `json:"jti"`
+				Iat int64  `json:"iat"`
+				Exp int64  `json:"exp"`
+			}
+			if err := json.Unmarshal(payload, &claims); err != nil {
+				t.Fatal(err)
+			}
+			if claims.Iss != "dexgate" || claims.Sub != "dexgate" || claims.Aud != audience || claims.Jti == "" {
+				t.Errorf("unexpected claims: %s", payload)
+			}
+			if claims.Exp-claims.Iat != int64(clientAssertionLifetime.Seconds()) {
+				t.Errorf("unexpected lifetime: %s", payload)
+			}
+			// Each assertion has its own jti, as the OIDC server may reject a replayed one
+			other, _ := ca.sign(audience)
+			if other == assertion {
+				t.Errorf("expected a new assertion on each call")
+			}
+		})
+	}
+}
+
+type recordingTransport struct {
+	request *http.Request
+	body    string
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, _ := ioutil.ReadAll(req.Body)
+	t.request, t.body = req, string(body)
+	return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+// The assertion audience is the endpoint URL, without query
+func TestClientAssertionTransport(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &clientAssertion{clientID: "dexgate"}
+	if err := ca.load(pemKey("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))); err != nil {
+		t.Fatal(err)
+	}
+	base := &recordingTransport{}
+	client := &http.Client{Transport: &clientAssertionTransport{base: base, assertion: ca}}
+	if _, err := client.PostForm("https://idp.example.com/token?x=1", url.Values{"grant_type": {"refresh_token"}}); err != nil {
+		t.Fatal(err)
+	}
+	form, err := url.ParseQuery(base.body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form.Get("grant_type") != "refresh_token" || form.Get("client_assertion_type") != clientAssertionType {
+		t.Errorf("unexpected form: %s", base.body)
+	}
+	jws, err := jose.ParseSigned(form.Get("client_assertion"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := jws.Verify(ca.publicKeys()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims struct {
+		Aud string `json:"aud"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Aud != "https://idp.example.com/token" {
+		t.Errorf("unexpected audience: %s", payload)
+	}
+	if base.request.ContentLength != int64(len(base.body)) {
+		t.Errorf("content length %d does not match the body length %d", base.request.ContentLength, len(base.body))
+	}
+}
@@ -0,0 +1,228 @@
+package oidcapp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// See https://www.rfc-editor.org/rfc/rfc8628#section-3.4
+const deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// Default values, if not provided by the OIDC server. See RFC 8628, section 3.2
+const (
+	deviceDefaultInterval = 5
+	deviceDefaultExpiry   = 5 * time.Minute
+)
+
+// ErrTooManyPending is returned by StartDeviceAuthorization() when the provider maximum of pending device authorizations is reached
+var ErrTooManyPending = errors.New("too many pending device authorizations")
+
+// DeviceAuthorization is the OIDC server response to a device authorization request. See RFC 8628, section 3.2
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval,omitempty"`
+}
+
+// DeviceError is an error response of the token endpoint, while polling. See RFC 8628, section 3.5
+// Code is one of 'authorization_pending', 'slow_down', 'access_denied', 'expired_token' or any other OAuth2 error code.
+type DeviceError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *DeviceError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Description)
+}
+
+// Pending tell if the client should keep polling
+func (e *DeviceError) Pending() bool {
+	return e.Code == "authorization_pending" || e.Code == "slow_down"
+}
+
+// SupportsDeviceFlow tell if the OIDC server provides a device_authorization_endpoint. False if not discovered yet.
+func (app *OidcApp) SupportsDeviceFlow() bool {
+	d, err := app.current()
+	return err == nil && d.metadata.DeviceAuthorizationEndpoint != ""
+}
+
+// StartDeviceAuthorization initiate a device authorization grant (RFC 8628).
+// The returned device code is registered, so only the ones initiated by dexgate are accepted by PollDeviceToken().
+func (app *OidcApp) StartDeviceAuthorization(ctx context.Context) (*DeviceAuthorization, error) {
+	d, err := app.current()
+	if err != nil {
+		return nil, err
+	}
+	if d.metadata.DeviceAuthorizationEndpoint == "" {
+		return nil, fmt.Errorf("device authorization grant is not supported by this OIDC server")
+	}
+	// Checked before the request, to not relay a flood of requests to the OIDC server
+	if app.deviceCodes.full(app.config.DeviceMaxPending) {
+		return nil, ErrTooManyPending
+	}
+	scopes := append([]string{}, app.config.Scopes...)
+	if !app.isOAuth2() {
+		// As for NewLoginURL(), no OIDC scopes for a plain OAuth2 server
+		scopes = append([]string{oidc.ScopeOpenID}, scopes...)
+		if d.offlineAsScope {
+			scopes = append(scopes, oidc.ScopeOfflineAccess)
+		}
+	}
+	form := url.Values{}
+	form.Set("scope", strings.Join(scopes, " "))
+	resp, body, err := app.postForm(ctx, d.metadata.DeviceAuthorizationEndpoint, form)
+	if err != nil {
+		return nil, fmt.Errorf("device authorization request failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("device authorization request failed: %s: %s", resp.Status, body)
+	}
+	authorization := &DeviceAuthorization{}
+	if err := json.Unmarshal(body, authorization); err != nil {
+		return nil, fmt.Errorf("error decoding device authorization response: %v", err)
+	}
+	if authorization.DeviceCode == "" || authorization.UserCode == "" || authorization.VerificationURI == "" {
+		return nil, fmt.Errorf("incomplete device authorization response: %s", body)
+	}
+	if authorization.Interval <= 0 {
+		authorization.Interval = deviceDefaultInterval
+	}
+	expiry := deviceDefaultExpiry
+	if authorization.ExpiresIn > 0 {
+		expiry = time.Duration(authorization.ExpiresIn) * time.Second
+	}
+	if !app.deviceCodes.add(authorization.DeviceCode, time.Now().Add(expiry), app.config.DeviceMaxPending) {
+		return nil, ErrTooManyPending
+	}
+	return authorization, nil
+}
+
+// PollDeviceToken query the token endpoint for a pending device authorization.
+// Return a *DeviceError if the OIDC server rejected the request. Its Pending() method tell if the client should keep polling.
+func (app *OidcApp) PollDeviceToken(ctx context.Context, deviceCode string) (*TokenData, error) {
+	d, err := app.current()
+	if err != nil {
+		return nil, err
+	}
+	if !app.deviceCodes.contains(deviceCode) {
+		return nil, &DeviceError{Code: "expired_token", Description: "unknown or expired device code"}
+	}
+	form := url.Values{}
+	form.Set("grant_type", deviceCodeGrantType)
+	form.Set("device_code", deviceCode)
+	resp, body, err := app.postForm(ctx, d.provider.Endpoint().TokenURL, form)
+	if err != nil {
+		return nil, fmt.Errorf("device token request failed: %v", err)
+	}
+	var tokenResponse struct {
+		DeviceError
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		IDToken      string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokenResponse); err != nil {
+		return nil, fmt.Errorf("device token request failed: %s: unable to decode response: %v", resp.Status, err)
+	}
+	if tokenResponse.Code != "" {
+		if !tokenResponse.Pending() {
+			app.deviceCodes.remove(deviceCode)
+		}
+		return nil, &tokenResponse.DeviceError
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("device token request failed: %s: %s", resp.Status, body)
+	}
+	// Device code is single use
+	app.deviceCodes.remove(deviceCode)
+	if tokenResponse.AccessToken == "" {
+		return nil, fmt.Errorf("no access_token in token response")
+	}
+	token := &oauth2.Token{
+		AccessToken:  tokenResponse.AccessToken,
+		TokenType:    tokenResponse.TokenType,
+		RefreshToken: tokenResponse.RefreshToken,
+	}
+	if tokenResponse.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
+	}
+	if app.isOAuth2() {
+		return app.newOAuth2TokenData(oidc.ClientContext(ctx, app.client), token)
+	}
+	if tokenResponse.IDToken == "" {
+		return nil, fmt.Errorf("no id_token in token response")
+	}
+	idToken, err := app.verifyIDToken(ctx, d, tokenResponse.IDToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify ID token: %v", err)
+	}
+	return app.newTokenData(oidc.ClientContext(ctx, app.client), d, token, tokenResponse.IDToken, idToken)
+}
+
+// deviceCodeSet keep track of the pending device authorizations, up to their expiry.
+type deviceCodeSet struct {
+	mutex   sync.Mutex
+	entries map[string]time.Time
+}
+
+// full tell if no more device code can be added. A maxSize of 0 means no limit
+func (c *deviceCodeSet) full(maxSize int) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.prune()
+	return maxSize > 0 && len(c.entries) >= maxSize
+}
+
+// add register a device code, unless the set is full
+func (c *deviceCodeSet) add(deviceCode string, expiry time.Time, maxSize int) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]time.Time)
+	}
+	c.prune()
+	if maxSize > 0 && len(c.entries) >= maxSize {
+		return false
+	}
+	c.entries[deviceCode] = expiry
+	return true
+}
+
+// prune remove the expired entries. Must be called with the mutex held
+func (c *deviceCodeSet) prune() {
+	now := time.Now()
+	for key, expiry := range c.entries {
+		if now.After(expiry) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (c *deviceCodeSet) contains(deviceCode string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	expiry, ok := c.entries[deviceCode]
+	return ok && time.Now().Before(expiry)
+}
+
+func (c *deviceCodeSet) remove(deviceCode string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.entries, deviceCode)
+}
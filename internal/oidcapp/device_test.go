@@ -0,0 +1,31 @@
+package oidcapp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeviceCodeSet(t *testing.T) {
+	codes := &deviceCodeSet{}
+	now := time.Now()
+	if !codes.add("expired", now.Add(-time.Second), 2) || !codes.add("pending", now.Add(time.Minute), 2) {
+		t.Fatal("expected the codes to be added")
+	}
+	if codes.contains("expired") || !codes.contains("pending") {
+		t.Error("expected only the pending code to be found")
+	}
+	// The expired code is pruned, to make room
+	if codes.full(2) || !codes.add("other", now.Add(time.Minute), 2) {
+		t.Fatal("expected the expired code to be pruned")
+	}
+	if !codes.full(2) || codes.add("refused", now.Add(time.Minute), 2) || codes.contains("refused") {
+		t.Error("expected the set to be full")
+	}
+	if codes.full(0) || !codes.add("unlimited", now.Add(time.Minute), 0) {
+		t.Error("expected no limit")
+	}
+	codes.remove("pending")
+	if codes.contains("pending") {
+		t.Error("expected the removed code to be missing")
+	}
+}
@@ -0,0 +1,267 @@
+package oidcapp
+
+import (
+	"context"
+	"dexgate/internal/config"
+	"errors"
+	"fmt"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNotReady is returned by operations requiring the OIDC server, while its discovery has not succeeded yet.
+var ErrNotReady = errors.New("OIDC provider is not available yet")
+
+// Discovery retry delays. The delay is doubled on each failure, up to the max.
+const (
+	discoveryMinBackoff = 1 * time.Second
+	discoveryMaxBackoff = 1 * time.Minute
+)
+
+// CrossClientScopePrefix is the scope requesting an ID token for another client, as defined by Dex
+const CrossClientScopePrefix = "audience:server:client_id:"
+
+// discovery hold all what is built from the OIDC server discovery document.
+// It is immutable once built, and swapped as a whole on refresh.
+type discovery struct {
+	provider       *oidc.Provider // Also hold the remote key set. So, a new one means fresh keys
+	verifier       *oidc.IDTokenVerifier
+	logoutVerifier *oidc.IDTokenVerifier
+	bearerVerifier *oidc.IDTokenVerifier
+	metadata       providerMetadata
+	offlineAsScope bool
+	fetchedAt      time.Time
+}
+
+// The part of the discovery document we are interested in.
+// See: https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
+type providerMetadata struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	// See: https://openid.net/specs/openid-connect-rpinitiated-1_0.html#OPMetadata
+	EndSessionEndpoint string `json:"end_session_endpoint"`
+	// See: https://www.rfc-editor.org/rfc/rfc8414#section-2
+	IntrospectionEndpoint string `json:"introspection_endpoint"`
+	// See: https://www.rfc-editor.org/rfc/rfc8628#section-4
+	DeviceAuthorizationEndpoint string   `json:"device_authorization_endpoint"`
+	ScopesSupported             []string `json:"scopes_supported"`
+	ResponseModesSupported      []string `json:"response_modes_supported"`
+}
+
+// MetadataStatus provide information about the discovery document in use, for monitoring.
+type MetadataStatus struct {
+	FetchedAt       time.Time // Zero if the provider has not been discovered yet
+	RefreshFailures uint64    // Number of failed refresh attempts, since startup
+}
+
+// Ready tell if the OIDC server discovery has succeeded.
+func (app *OidcApp) Ready() bool {
+	_, err := app.current()
+	return err == nil
+}
+
+func (app *OidcApp) MetadataStatus() MetadataStatus {
+	status := MetadataStatus{
+		RefreshFailures: atomic.LoadUint64(&app.refreshFailures),
+	}
+	if d, err := app.current(); err == nil {
+		status.FetchedAt = d.fetchedAt
+	}
+	return status
+}
+
+// current return the discovery in use. ErrNotReady if none, or the failure preventing the provider use
+func (app *OidcApp) current() (*discovery, error) {
+	d, ok := app.discovery.Load().(*discovery)
+	if !ok {
+		if err, failed := app.failure.Load().(error); failed {
+			return nil, err
+		}
+		return nil, ErrNotReady
+	}
+	return d, nil
+}
+
+// discoverLoop retry the discovery with exponential backoff, up to the first success.
+// Then, refresh it periodically, if configured so. It ends when the app is closed.
+// Metadata not matching the configuration (i.e. unsupported scopes) are a configuration error: The provider is then not usable.
+func (app *OidcApp) discoverLoop() {
+	delay := discoveryMinBackoff
+	for {
+		d, err := app.discover()
+		if err == nil {
+			if err := app.checkScopes(d); err != nil {
+				config.Log.Errorf("Provider '%s': %v. Fix the configuration: This provider is not usable", app.config.Name, err)
+				app.failure.Store(fmt.Errorf("provider '%s' configuration error: %v", app.config.Name, err))
+				return
+			}
+			app.logDiscovery(d)
+			app.discovery.Store(d)
+			break
+		}
+		config.Log.Errorf("Provider '%s': %v. Will retry in %s", app.config.Name, err, delay.String())
+		select {
+		case <-app.done:
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > discoveryMaxBackoff {
+			delay = discoveryMaxBackoff
+		}
+	}
+	if app.config.MetadataRefreshPeriod <= 0 {
+		return
+	}
+	ticker := time.NewTicker(app.config.MetadataRefreshPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-app.done:
+			return
+		case <-ticker.C:
+			app.refreshDiscovery()
+		}
+	}
+}
+
+// refreshDiscovery fetch again the discovery document and the keys. On failure, the current ones are kept.
+func (app *OidcApp) refreshDiscovery() {
+	d, err := app.discover()
+	if err != nil {
+		atomic.AddUint64(&app.refreshFailures, 1)
+		config.Log.Warnf("Provider '%s': metadata refresh failed: %v. Keep the ones fetched at %s", app.config.Name, err, app.MetadataStatus().FetchedAt.String())
+		return
+	}
+	if previous, err := app.current(); err == nil {
+		app.logMetadataChanges(&previous.metadata, &d.metadata)
+	}
+	if err := app.checkScopes(d); err != nil {
+		// The configuration was validated on the first discovery. So, this is a change on the OIDC server side,
+		// which may be transient. It is the reference: Its new metadata are used anyway
+		config.Log.Errorf("Provider '%s': %v. Login may fail", app.config.Name, err)
+	}
+	app.discovery.Store(d)
+	config.Log.Debugf("Provider '%s': metadata refreshed", app.config.Name)
+}
+
+func (app *OidcApp) discover() (*discovery, error) {
+	oidcConfig := app.config
+	d := &discovery{
+		fetchedAt: time.Now(),
+	}
+	var err error
+	ctx := oidc.ClientContext(context.Background(), app.client)
+	d.provider, err = oidc.NewProvider(ctx, oidcConfig.IssuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query provider %q: %v", oidcConfig.IssuerURL, err)
+	}
+	// ID tokens audience and authorized party are checked by verifyIDToken()
+	d.verifier = d.provider.Verifier(app.verifierConfig(oidc.Config{SkipClientIDCheck: true}))
+	// Logout tokens may not have an expiration. This is checked by VerifyLogoutToken()
+	d.logoutVerifier = d.provider.Verifier(app.verifierConfig(oidc.Config{ClientID: oidcConfig.ClientID, SkipExpiryCheck: true}))
+	// Bearer tokens audience is checked against an allowlist by VerifyBearerToken()
+	d.bearerVerifier = d.provider.Verifier(app.verifierConfig(oidc.Config{SkipClientIDCheck: true}))
+
+	if err := d.provider.Claims(&d.metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse provider metadata: %v", err)
+	}
+	// Following is copied from dex/exammple/example.-app/main.go
+	if len(d.metadata.ScopesSupported) == 0 {
+		// scopes_supported is a "RECOMMENDED" discovery claim, not a required
+		// one. If missing, assume that the provider follows the spec and has
+		// an "offline_access" scope.
+		d.offlineAsScope = true
+	} else {
+		// See if scopes_supported has the "offline_access" scope.
+		d.offlineAsScope = func() bool {
+			for _, scope := range d.metadata.ScopesSupported {
+				if scope == oidc.ScopeOfflineAccess {
+					return true
+				}
+			}
+			return false
+		}()
+	}
+	return d, nil
+}
+
+// checkScopes check if configured scopes match the supported one.
+// With configured endpoints, this check is performed only if the supported scopes are configured too.
+func (app *OidcApp) checkScopes(d *discovery) error {
+	if app.config.Endpoints != nil && len(d.metadata.ScopesSupported) == 0 {
+		return nil
+	}
+	ssmap := make(map[string]bool)
+	for _, scope := range d.metadata.ScopesSupported {
+		ssmap[scope] = true
+	}
+	for _, scope := range app.config.Scopes {
+		// Dex cross-client scopes are not advertised
+		if strings.HasPrefix(scope, CrossClientScopePrefix) {
+			continue
+		}
+		if _, ok := ssmap[scope]; !ok {
+			return fmt.Errorf("Scope '%s' is not supported by this OIDC server", scope)
+		}
+	}
+	return nil
+}
+
+func (app *OidcApp) logDiscovery(d *discovery) {
+	oidcConfig := app.config
+	if oidcConfig.Endpoints != nil {
+		config.Log.Infof("Provider %q built from configured endpoints (No discovery)", oidcConfig.IssuerURL)
+	} else if oidcConfig.LoginURLOverride == "" {
+		config.Log.Infof("Successfully queried provider %q", oidcConfig.IssuerURL)
+	} else {
+		config.Log.Infof("Successfully queried provider %q. (NB: Login URL will be overriden by '%s')", oidcConfig.IssuerURL, oidcConfig.LoginURLOverride)
+	}
+	if d.metadata.EndSessionEndpoint != "" {
+		config.Log.Infof("Provider support RP-initiated logout (end_session_endpoint: %s)", d.metadata.EndSessionEndpoint)
+	}
+	config.Log.Infof("Provider '%s': Request scopes: %s", oidcConfig.Name, strings.Join(oidcConfig.Scopes, ", "))
+	if oidcConfig.ResponseMode != "query" && len(d.metadata.ResponseModesSupported) > 0 && len(missingFrom([]string{oidcConfig.ResponseMode}, d.metadata.ResponseModesSupported)) > 0 {
+		config.Log.Warnf("Provider '%s': response mode '%s' is not in response_modes_supported (%s)", oidcConfig.Name, oidcConfig.ResponseMode, strings.Join(d.metadata.ResponseModesSupported, ", "))
+	}
+}
+
+func (app *OidcApp) logMetadataChanges(previous *providerMetadata, current *providerMetadata) {
+	logChange := func(name string, previous string, current string) {
+		if previous != current {
+			config.Log.Infof("Provider '%s': %s changed from '%s' to '%s'", app.config.Name, name, previous, current)
+		}
+	}
+	logChange("authorization_endpoint", previous.AuthorizationEndpoint, current.AuthorizationEndpoint)
+	logChange("token_endpoint", previous.TokenEndpoint, current.TokenEndpoint)
+	logChange("userinfo_endpoint", previous.UserInfoEndpoint, current.UserInfoEndpoint)
+	logChange("jwks_uri", previous.JWKSURI, current.JWKSURI)
+	logChange("end_session_endpoint", previous.EndSessionEndpoint, current.EndSessionEndpoint)
+	logChange("introspection_endpoint", previous.IntrospectionEndpoint, current.IntrospectionEndpoint)
+	logChange("device_authorization_endpoint", previous.DeviceAuthorizationEndpoint, current.DeviceAuthorizationEndpoint)
+	if added := missingFrom(current.ScopesSupported, previous.ScopesSupported); len(added) > 0 {
+		config.Log.Infof("Provider '%s': scopes added to scopes_supported: %s", app.config.Name, strings.Join(added, ", "))
+	}
+	if removed := missingFrom(previous.ScopesSupported, current.ScopesSupported); len(removed) > 0 {
+		config.Log.Warnf("Provider '%s': scopes removed from scopes_supported: %s", app.config.Name, strings.Join(removed, ", "))
+	}
+}
+
+// missingFrom return the values which are not in reference
+func missingFrom(values []string, reference []string) []string {
+	set := make(map[string]bool)
+	for _, value := range reference {
+		set[value] = true
+	}
+	var missing []string
+	for _, value := range values {
+		if !set[value] {
+			missing = append(missing, value)
+		}
+	}
+	return missing
+}
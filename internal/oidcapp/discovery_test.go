@@ -0,0 +1,105 @@
+package oidcapp
+
+import (
+	"dexgate/internal/config"
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func init() {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	config.Log = logrus.NewEntry(logger)
+}
+
+// newTestIssuer serve a discovery document, advertising the provided scopes. The returned counter is the number of requests
+func newTestIssuer(t *testing.T, scopes []string) (*httptest.Server, *int32) {
+	var requests int32
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 server.URL,
+			"authorization_endpoint": server.URL + "/auth",
+			"token_endpoint":         server.URL + "/token",
+			"jwks_uri":               server.URL + "/keys",
+			"scopes_supported":       scopes,
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	for i := 0; !condition(); i++ {
+		if i == 100 {
+			t.Fatal("timeout")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string
+		ready  bool
+	}{
+		{"supported scopes", []string{"openid", "profile", "groups"}, true},
+		{"unsupported scope", []string{"openid", "profile"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			issuer, requests := newTestIssuer(t, test.scopes)
+			app, err := NewOidcApp(&config.OidcConfig{
+				Name:      "test",
+				IssuerURL: issuer.URL,
+				Scopes:    []string{"profile", "groups", CrossClientScopePrefix + "peer"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer app.Close()
+			waitFor(t, func() bool {
+				_, err := app.current()
+				return !errors.Is(err, ErrNotReady)
+			})
+			if app.Ready() != test.ready {
+				t.Fatalf("expected ready %v", test.ready)
+			}
+			if !test.ready {
+				// A configuration error is not retried
+				time.Sleep(discoveryMinBackoff + 200*time.Millisecond)
+				if n := atomic.LoadInt32(requests); n != 1 {
+					t.Errorf("expected a single discovery request, got %d", n)
+				}
+				if _, err := app.NewLoginURL(&LoginContext{}); err == nil || errors.Is(err, ErrNotReady) {
+					t.Errorf("expected a configuration error, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestDiscoveryClose(t *testing.T) {
+	issuer, requests := newTestIssuer(t, nil)
+	issuer.Close()
+	app, err := NewOidcApp(&config.OidcConfig{Name: "test", IssuerURL: issuer.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Close()
+	// The loop ends on its first retry wait. Then, the provider is never discovered
+	time.Sleep(100 * time.Millisecond)
+	if app.Ready() || atomic.LoadInt32(requests) != 0 {
+		t.Errorf("unexpected discovery")
+	}
+}
@@ -0,0 +1,39 @@
+package oidcapp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Introspect query the OIDC server introspection endpoint about an opaque token (RFC 7662).
+// Return the raw introspection response attributes. It is up to the caller to check the 'active' one.
+func (app *OidcApp) Introspect(ctx context.Context, token string) (map[string]interface{}, error) {
+	d, err := app.current()
+	if err != nil {
+		return nil, err
+	}
+	if d.metadata.IntrospectionEndpoint == "" {
+		return nil, fmt.Errorf("token introspection is not supported by this OIDC server")
+	}
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
+	resp, body, err := app.postForm(ctx, d.metadata.IntrospectionEndpoint, form)
+	if err != nil {
+		return nil, fmt.Errorf("introspection request failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection request failed: %s: %s", resp.Status, body)
+	}
+	attributes := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&attributes); err != nil {
+		return nil, fmt.Errorf("error decoding introspection response: %v", err)
+	}
+	return attributes, nil
+}
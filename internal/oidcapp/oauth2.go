@@ -0,0 +1,157 @@
+package oidcapp
+
+import (
+	"bytes"
+	"context"
+	"dexgate/internal/config"
+	"dexgate/internal/identity"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/oauth2"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Max number of pages fetched from the groups API, to avoid endless loop on a faulty server
+const oauth2MaxGroupPages = 20
+
+// Link to the next page, as provided by GitHub and other APIs. See https://www.rfc-editor.org/rfc/rfc8288
+var nextLinkRegexp = regexp.MustCompile(`<([^>]*)>\s*;[^,]*rel="?next"?`)
+
+// isOAuth2 tell if the provider is a plain OAuth2 server (No ID token). The user identity is then fetched from its API.
+func (app *OidcApp) isOAuth2() bool {
+	return app.config.Type == config.ProviderTypeOAuth2
+}
+
+// newOAuth2TokenData build the TokenData of a plain OAuth2 provider, from the user and groups APIs.
+// Claims are the user API ones, plus 'iss', 'sub', 'groups' (if oidc.oauth2.groupsURL is set) and 'email_verified' (if oidc.oauth2.trustEmail is set),
+// so they can be handled as those of an ID token.
+func (app *OidcApp) newOAuth2TokenData(ctx context.Context, token *oauth2.Token) (*TokenData, error) {
+	oauth2Config := &app.config.OAuth2
+	claims := make(map[string]interface{})
+	if err := app.getAPI(ctx, oauth2Config.UserURL, token.AccessToken, &claims); err != nil {
+		return nil, fmt.Errorf("failed to get user information: %v", err)
+	}
+	subject, ok := identity.Lookup(claims, oauth2Config.SubjectField)
+	if !ok || subject == nil || fmt.Sprint(subject) == "" {
+		return nil, fmt.Errorf("no '%s' field in user information", oauth2Config.SubjectField)
+	}
+	claims["iss"] = app.config.IssuerURL
+	claims["sub"] = fmt.Sprint(subject)
+	if oauth2Config.GroupsURL != "" {
+		groups, err := app.getOAuth2Groups(ctx, token.AccessToken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get user groups: %v", err)
+		}
+		claims["groups"] = groups
+	}
+	if oauth2Config.TrustEmail {
+		if email, _ := claims["email"].(string); email != "" {
+			claims["email_verified"] = true
+		}
+	}
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenData{
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		Expiry:       token.Expiry,
+		Subject:      fmt.Sprint(subject),
+		RedirectURL:  app.config.RedirectURL,
+		Claims:       string(data),
+	}, nil
+}
+
+// getOAuth2Groups fetch all pages of the groups API. Each item may be a string, or an object from which
+// the group name is built by joining the oidc.oauth2.groupFields values with '/' (i.e. 'myorg/myteam')
+func (app *OidcApp) getOAuth2Groups(ctx context.Context, accessToken string) ([]string, error) {
+	groups := make([]string, 0)
+	pageURL := app.config.OAuth2.GroupsURL
+	for page := 0; pageURL != "" && page < oauth2MaxGroupPages; page++ {
+		var items []interface{}
+		next, err := app.getAPIPage(ctx, pageURL, accessToken, &items)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			switch v := item.(type) {
+			case string:
+				groups = append(groups, v)
+			case map[string]interface{}:
+				parts := make([]string, 0, len(app.config.OAuth2.GroupFields))
+				for _, field := range app.config.OAuth2.GroupFields {
+					if value, ok := identity.Lookup(v, field); ok && value != nil {
+						parts = append(parts, fmt.Sprint(value))
+					}
+				}
+				if len(parts) > 0 {
+					groups = append(groups, strings.Join(parts, "/"))
+				}
+			}
+		}
+		pageURL = next
+	}
+	return groups, nil
+}
+
+func (app *OidcApp) getAPI(ctx context.Context, apiURL string, accessToken string, result interface{}) error {
+	_, err := app.getAPIPage(ctx, apiURL, accessToken, result)
+	return err
+}
+
+// getAPIPage perform an authenticated GET on the API and decode the JSON response.
+// Return the URL of the next page, if the response provide one in a Link header.
+func (app *OidcApp) getAPIPage(ctx context.Context, apiURL string, accessToken string, result interface{}) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	resp, err := app.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("unable to read response from %s: %v", apiURL, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s: %s", apiURL, resp.Status, body)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber() // Keep numeric ids as is
+	if err := decoder.Decode(result); err != nil {
+		return "", fmt.Errorf("unable to decode response from %s: %v", apiURL, err)
+	}
+	return nextPageURL(resp, apiURL), nil
+}
+
+// nextPageURL return the 'next' link of the response, if any. As the user access token is sent to it, it must be on the same
+// scheme and host as the current page (So, as oidc.oauth2.groupsURL).
+func nextPageURL(resp *http.Response, current string) string {
+	for _, link := range resp.Header.Values("Link") {
+		if m := nextLinkRegexp.FindStringSubmatch(link); m != nil {
+			base, err := url.Parse(current)
+			if err != nil {
+				return ""
+			}
+			next, err := base.Parse(m[1])
+			if err != nil {
+				return ""
+			}
+			if next.Scheme != base.Scheme || next.Host != base.Host {
+				config.Log.Warnf("Ignoring next page link '%s' of %s: not on the same host", next.String(), current)
+				return ""
+			}
+			return next.String()
+		}
+	}
+	return ""
+}
@@ -2,143 +2,153 @@ package oidcapp
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"dexgate/internal/config"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/coreos/go-oidc/v3/oidc"
 	"golang.org/x/oauth2"
-	"net"
+	"io/ioutil"
 	"net/http"
 	"net/url"
-	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const DexgateAppState = "WhatANiceAuthStuff"
-
 type OidcApp struct {
-	config         *config.OidcConfig
-	client         *http.Client
-	provider       *oidc.Provider
-	verifier       *oidc.IDTokenVerifier
-	offlineAsScope bool
+	refreshFailures uint64 // Accessed atomically. First field, to be 64-bit aligned
+	config          *config.OidcConfig
+	client          *http.Client
+	authClient      *http.Client // For requests requiring client authentication. Same as client, unless private_key_jwt is used
+	assertion       *clientAssertion
+	discovery       atomic.Value  // *discovery. Unset until the OIDC server has been successfully queried
+	failure         atomic.Value  // error. Set if the OIDC server metadata don't match the configuration. Discovery is then stopped
+	done            chan struct{} // Closed by Close(), to stop the discovery loop
+	closeOnce       sync.Once
+	refreshes       refreshGroup
+	logoutJtis      jtiCache
+	deviceCodes     deviceCodeSet
 }
 
 func NewOidcApp(oidcConfig *config.OidcConfig) (*OidcApp, error) {
-	var err error
 	app := &OidcApp{
 		config: oidcConfig,
+		done:   make(chan struct{}),
 	}
 	// We build a specific http.client, for
+	// - Setup SSL connection, proxy and timeouts (oidc.transport)
 	// - Allowing some Debug on exchange
-	// - Setup SSL connection (TODO)
-	if oidcConfig.RootCAFile != "" {
-		client, err := httpClientForRootCAs(oidcConfig.RootCAFile)
-		if err != nil {
-			return nil, err
-		}
-		app.client = client
-	}
-	if oidcConfig.Debug {
-		if app.client == nil {
-			app.client = &http.Client{
-				Transport: debugTransport{http.DefaultTransport},
-			}
-		} else {
-			app.client.Transport = debugTransport{app.client.Transport}
-		}
-	}
-	if app.client == nil {
-		app.client = http.DefaultClient
-	}
-	ctx := oidc.ClientContext(context.Background(), app.client)
-	app.provider, err = oidc.NewProvider(ctx, oidcConfig.IssuerURL)
+	transport, err := newReloadingTransport(oidcConfig)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query provider %q: %v", oidcConfig.IssuerURL, err)
-	}
-	if oidcConfig.LoginURLOverride == "" {
-		config.Log.Infof("Successfully queried provider %q", oidcConfig.IssuerURL)
-	} else {
-		config.Log.Infof("Successfully queried provider %q. (NB: Login URL will be overriden by '%s')", oidcConfig.IssuerURL, oidcConfig.LoginURLOverride)
+		return nil, err
 	}
-	app.verifier = app.provider.Verifier(&oidc.Config{ClientID: oidcConfig.ClientID})
-
-	// Following is copied from dex/exammple/example.-app/main.go
-	var s struct {
-		// What scopes does a provider support?
-		//
-		// See: https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
-		ScopesSupported []string `json:"scopes_supported"`
+	var base http.RoundTripper = transport
+	if oidcConfig.Debug {
+		base = debugTransport{base}
 	}
-	if err := app.provider.Claims(&s); err != nil {
-		return nil, fmt.Errorf("failed to parse provider scopes_supported: %v", err)
+	if oidcConfig.Endpoints != nil {
+		// No discovery document on the OIDC server. Use the configured endpoints
+		if base, err = newStaticDiscoveryTransport(oidcConfig, base); err != nil {
+			return nil, err
+		}
 	}
-	if len(s.ScopesSupported) == 0 {
-		// scopes_supported is a "RECOMMENDED" discovery claim, not a required
-		// one. If missing, assume that the provider follows the spec and has
-		// an "offline_access" scope.
-		app.offlineAsScope = true
-	} else {
-		// See if scopes_supported has the "offline_access" scope.
-		app.offlineAsScope = func() bool {
-			for _, scope := range s.ScopesSupported {
-				if scope == oidc.ScopeOfflineAccess {
-					return true
-				}
-			}
-			return false
-		}()
-	}
-	// Check if configured scopes match the supported one.
-	ssmap := make(map[string]bool)
-	for _, scope := range s.ScopesSupported {
-		ssmap[scope] = true
-	}
-	for _, scope := range config.Conf.OidcConfig.Scopes {
-		if _, ok := ssmap[scope]; !ok {
-			return nil, fmt.Errorf("Scope '%s' is not supported by this OIDC server", scope)
+	app.client = &http.Client{Transport: base}
+	app.authClient = app.client
+	if oidcConfig.ClientAssertionKeyFile != "" {
+		if app.assertion, err = newClientAssertion(oidcConfig); err != nil {
+			return nil, err
+		}
+		app.authClient = &http.Client{
+			Transport: &clientAssertionTransport{base: base, assertion: app.assertion},
 		}
 	}
+	// Discovery is performed in background, so dexgate can start while the OIDC server is not available.
+	go app.discoverLoop()
 	return app, nil
 }
 
-// return an HTTP client which trusts the provided root CAs.
-func httpClientForRootCAs(rootCAs string) (*http.Client, error) {
-	tlsConfig := tls.Config{RootCAs: x509.NewCertPool()}
-	rootCABytes, err := os.ReadFile(rootCAs)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read root-ca: %v", err)
-	}
-	if !tlsConfig.RootCAs.AppendCertsFromPEM(rootCABytes) {
-		return nil, fmt.Errorf("no certs found in root CA file %q", rootCAs)
-	}
-	config.Log.Infof("CA file '%s' loaded successfully.", rootCAs)
-	return &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tlsConfig,
-			Proxy:           http.ProxyFromEnvironment,
-			Dial: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).Dial,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		},
-	}, nil
+// Close stop the background discovery and metadata refresh
+func (app *OidcApp) Close() {
+	app.closeOnce.Do(func() { close(app.done) })
+}
+
+func (app *OidcApp) IssuerURL() string {
+	return app.config.IssuerURL
 }
 
-func (app *OidcApp) oauth2Config(scopes []string) *oauth2.Config {
+// ClientID return the OAuth2 client ID of this application on the provider. Also the audience of the ID tokens
+func (app *OidcApp) ClientID() string {
+	return app.config.ClientID
+}
+
+// BearerAudiences return the audiences accepted for the bearer tokens issued by this provider
+func (app *OidcApp) BearerAudiences() []string {
+	return app.config.BearerAudiences
+}
+
+// Name return the provider identifier, as stored in the session
+func (app *OidcApp) Name() string {
+	return app.config.Name
+}
+
+// DisplayName return the provider label, for the login chooser page
+func (app *OidcApp) DisplayName() string {
+	return app.config.DisplayName
+}
+
+// PostLogoutRedirectURL return where the user should land after logout. May be empty
+func (app *OidcApp) PostLogoutRedirectURL() string {
+	return app.config.PostLogoutRedirectURL
+}
+
+func (app *OidcApp) oauth2Config(d *discovery, scopes []string) *oauth2.Config {
+	endpoint := d.provider.Endpoint()
+	if app.config.ClientSecret == "" {
+		// Public client, or private_key_jwt (Client assertion is added by authClient). Only the client_id is sent to the token endpoint
+		endpoint.AuthStyle = oauth2.AuthStyleInParams
+	}
 	return &oauth2.Config{
 		ClientID:     app.config.ClientID,
 		ClientSecret: app.config.ClientSecret,
-		Endpoint:     app.provider.Endpoint(),
+		Endpoint:     endpoint,
 		Scopes:       scopes,
 		RedirectURL:  app.config.RedirectURL,
 	}
 }
 
+// postForm send an authenticated request to an OIDC server endpoint (Token, introspection, ...), and return the response and its body.
+func (app *OidcApp) postForm(ctx context.Context, endpoint string, form url.Values) (*http.Response, []byte, error) {
+	if app.config.ClientSecret == "" {
+		// Public client, or private_key_jwt (Client assertion is added by authClient). Only the client_id is sent
+		form.Set("client_id", app.config.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if app.config.ClientSecret != "" {
+		// RFC 6749, section 2.3.1: client credentials are form-urlencoded before being used for basic authentication
+		req.SetBasicAuth(url.QueryEscape(app.config.ClientID), url.QueryEscape(app.config.ClientSecret))
+	}
+	resp, err := app.authClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read response: %v", err)
+	}
+	return resp, body, nil
+}
+
 func (app *OidcApp) hackUrl(loginUrl string) (string, error) {
 	if app.config.LoginURLOverride == "" {
 		return loginUrl, nil
@@ -154,75 +164,279 @@ func (app *OidcApp) hackUrl(loginUrl string) (string, error) {
 	}
 }
 
-func (app *OidcApp) NewLoginURL() (string, error) {
+// LoginContext hold the random values generated for a login attempt.
+// They must be kept in the user session, to be checked on callback.
+type LoginContext struct {
+	State        string            // Bound to the callback request, to prevent CSRF
+	Nonce        string            // Bound to the ID token, to prevent replay
+	CodeVerifier string            // PKCE code verifier. Empty if PKCE is disabled
+	AuthParams   map[string]string // Additional authorization request parameters (acr_values, max_age, prompt, ...). Not stored in session
+}
+
+func (app *OidcApp) NewLoginContext() (*LoginContext, error) {
+	state, err := randomString(32)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate login state: %w", err)
+	}
+	nonce, err := randomString(32)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate login nonce: %w", err)
+	}
+	loginContext := &LoginContext{
+		State: state,
+		Nonce: nonce,
+	}
+	if *app.config.PKCE {
+		// RFC 7636: 32 random bytes provide a 43 characters verifier
+		if loginContext.CodeVerifier, err = randomString(32); err != nil {
+			return nil, fmt.Errorf("unable to generate PKCE code verifier: %w", err)
+		}
+	}
+	return loginContext, nil
+}
+
+// PassthroughAuthParams return the query parameters of the requested URL to forward to the authorization request,
+// as whitelisted by configuration (i.e. 'login_hint'). Only the first value of each parameter is retained.
+func (app *OidcApp) PassthroughAuthParams(query url.Values) map[string]string {
+	params := make(map[string]string)
+	for _, name := range app.config.AuthParamsPassthrough {
+		if value := query.Get(name); value != "" {
+			params[name] = value
+		}
+	}
+	return params
+}
+
+func randomString(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// NewLoginURL return the OIDC server login URL. ErrNotReady if the OIDC server has not been discovered yet.
+func (app *OidcApp) NewLoginURL(loginContext *LoginContext) (string, error) {
+	d, err := app.current()
+	if err != nil {
+		return "", err
+	}
 	//scopes := []string{"openid", "profile", "email", "groups"}
 	var urls string
-	scopes := make([]string, len(config.Conf.OidcConfig.Scopes))
-	copy(scopes, config.Conf.OidcConfig.Scopes)
+	var opts []oauth2.AuthCodeOption
+	if !app.isOAuth2() {
+		opts = append(opts, oidc.Nonce(loginContext.Nonce))
+	}
+	if loginContext.CodeVerifier != "" {
+		challenge := sha256.Sum256([]byte(loginContext.CodeVerifier))
+		opts = append(opts, oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])))
+		opts = append(opts, oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+	}
+	if app.config.ResponseMode != "query" {
+		opts = append(opts, oauth2.SetAuthURLParam("response_mode", app.config.ResponseMode))
+	}
+	// Configured parameters first, so they can be overridden by the per login ones
+	for name, value := range app.config.ExtraAuthParams {
+		opts = append(opts, oauth2.SetAuthURLParam(name, value))
+	}
+	for name, value := range loginContext.AuthParams {
+		opts = append(opts, oauth2.SetAuthURLParam(name, value))
+	}
+	scopes := make([]string, len(app.config.Scopes))
+	copy(scopes, app.config.Scopes)
+	if app.isOAuth2() {
+		// No OIDC scopes. Issuing a refresh token is up to the OAuth2 server
+		urls = app.oauth2Config(d, scopes).AuthCodeURL(loginContext.State, opts...)
+		return app.hackUrl(urls)
+	}
 	scopes = append(scopes, "openid") // This is required
-	if app.offlineAsScope {
+	if d.offlineAsScope {
 		scopes = append(scopes, "offline_access")
-		urls = app.oauth2Config(scopes).AuthCodeURL(DexgateAppState)
+		urls = app.oauth2Config(d, scopes).AuthCodeURL(loginContext.State, opts...)
 	} else {
-		urls = app.oauth2Config(scopes).AuthCodeURL(DexgateAppState, oauth2.AccessTypeOffline)
+		opts = append(opts, oauth2.AccessTypeOffline)
+		urls = app.oauth2Config(d, scopes).AuthCodeURL(loginContext.State, opts...)
 	}
 	return app.hackUrl(urls)
 }
 
-func (app *OidcApp) CheckCallbackRequest(r *http.Request) (code string, errMsg string) {
-	if r.Method == http.MethodGet {
-		if errMsg := r.FormValue("error"); errMsg != "" {
-			return "", fmt.Sprintf("%s: %s", errMsg, r.FormValue("error_description"))
-		}
-		code := r.FormValue("code")
-		if code == "" {
-			return "", fmt.Sprintf("no code in request: %q", r.Form)
-		}
-		if state := r.FormValue("state"); state != DexgateAppState {
-			return "", fmt.Sprintf("expected state %q got %q", DexgateAppState, state)
+// NewLogoutURL return the URL to redirect the user to, for logging out from the OIDC server.
+// Empty if the provider does not support RP-initiated logout, or is not available.
+func (app *OidcApp) NewLogoutURL(idToken string) (string, error) {
+	d, err := app.current()
+	if err != nil || d.metadata.EndSessionEndpoint == "" {
+		return "", nil
+	}
+	logoutURL, err := url.Parse(d.metadata.EndSessionEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("Error in parsing end_session_endpoint '%s': %w", d.metadata.EndSessionEndpoint, err)
+	}
+	v := logoutURL.Query()
+	v.Set("client_id", app.config.ClientID)
+	if idToken != "" {
+		v.Set("id_token_hint", idToken)
+	}
+	if app.config.PostLogoutRedirectURL != "" {
+		v.Set("post_logout_redirect_uri", app.config.PostLogoutRedirectURL)
+	}
+	logoutURL.RawQuery = v.Encode()
+	return app.hackUrl(logoutURL.String())
+}
+
+// CheckCallbackRequest validate the callback request against the state stored in the session.
+// An empty expectedState means there is no pending login for this session (Unknown, already used or expired state).
+// The response is in the query for the 'query' response mode, and in the POSTed form for the 'form_post' one.
+func (app *OidcApp) CheckCallbackRequest(r *http.Request, expectedState string) (code string, errMsg string) {
+	var params url.Values
+	switch {
+	case r.Method == http.MethodGet:
+		params = r.URL.Query()
+	case r.Method == http.MethodPost && app.config.ResponseMode == "form_post":
+		if err := r.ParseForm(); err != nil {
+			return "", fmt.Sprintf("unable to parse callback form: %v", err)
 		}
-		return code, ""
-	} else {
+		params = r.PostForm
+	default:
 		return "", fmt.Sprintf("method not implemented: %s", r.Method)
 	}
+	if errMsg := params.Get("error"); errMsg != "" {
+		return "", fmt.Sprintf("%s: %s", errMsg, params.Get("error_description"))
+	}
+	code = params.Get("code")
+	if code == "" {
+		return "", fmt.Sprintf("no code in request: %q", params)
+	}
+	state := params.Get("state")
+	if state == "" {
+		return "", "no state in request"
+	}
+	if expectedState == "" {
+		return "", "no pending login for this session. The login state is unknown, already used or expired"
+	}
+	if subtle.ConstantTimeCompare([]byte(state), []byte(expectedState)) != 1 {
+		return "", "login state does not match the one of this session"
+	}
+	return code, ""
 }
 
 type TokenData struct {
-	IDToken      string
-	AccessToken  string
-	RefreshToken string
-	RedirectURL  string
-	Claims       string
+	IDToken       string
+	AccessToken   string
+	RefreshToken  string
+	Expiry        time.Time // Access token expiration. Zero if not provided by the OIDC server
+	IDTokenExpiry time.Time
+	Subject       string    // sub claim
+	Sid           string    // OIDC session ID (sid claim). Empty if not provided by the OIDC server
+	AuthTime      time.Time // When the user authenticated (auth_time claim). Zero if not provided by the OIDC server
+	Acr           string    // Authentication context class (acr claim). Empty if not provided by the OIDC server
+	Amr           []string  // Authentication methods (amr claim)
+	RedirectURL   string
+	Claims        string
 }
 
-func (app *OidcApp) HandleCallbackRequest(r *http.Request, code string) (tokenData *TokenData, errMsg string) {
+func sessionID(idToken *oidc.IDToken) string {
+	var claims struct {
+		Sid string `json:"sid"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return ""
+	}
+	return claims.Sid
+}
+
+func authContext(idToken *oidc.IDToken) (acr string, amr []string) {
+	var claims struct {
+		Acr string   `json:"acr"`
+		Amr []string `json:"amr"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return "", nil
+	}
+	return claims.Acr, claims.Amr
+}
+
+func authTime(idToken *oidc.IDToken) time.Time {
+	var claims struct {
+		AuthTime float64 `json:"auth_time"`
+	}
+	if err := idToken.Claims(&claims); err != nil || claims.AuthTime == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(claims.AuthTime), 0)
+}
+
+func (app *OidcApp) HandleCallbackRequest(r *http.Request, code string, loginContext *LoginContext) (tokenData *TokenData, errMsg string) {
+	d, err := app.current()
+	if err != nil {
+		return nil, err.Error()
+	}
 	ctx := oidc.ClientContext(r.Context(), app.client)
-	oauth2Config := app.oauth2Config(nil)
-	token, err := oauth2Config.Exchange(ctx, code)
+	oauth2Config := app.oauth2Config(d, nil)
+	var opts []oauth2.AuthCodeOption
+	if *app.config.PKCE {
+		if loginContext.CodeVerifier == "" {
+			return nil, "no PKCE code verifier in this session"
+		}
+		opts = append(opts, oauth2.SetAuthURLParam("code_verifier", loginContext.CodeVerifier))
+	}
+	token, err := oauth2Config.Exchange(oidc.ClientContext(r.Context(), app.authClient), code, opts...)
 	if err != nil {
 		return nil, fmt.Sprintf("failed to get token: %v", err)
 	}
+	if app.isOAuth2() {
+		if tokenData, err = app.newOAuth2TokenData(ctx, token); err != nil {
+			return nil, err.Error()
+		}
+		return tokenData, ""
+	}
 	rawIDToken, ok := token.Extra("id_token").(string)
 	if !ok {
 		return nil, "no id_token in token response"
 	}
-	idToken, err := app.verifier.Verify(r.Context(), rawIDToken)
+	idToken, err := app.verifyIDToken(r.Context(), d, rawIDToken)
 	if err != nil {
 		return nil, fmt.Sprintf("failed to verify ID token: %v", err)
 	}
+	if loginContext.Nonce == "" || subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(loginContext.Nonce)) != 1 {
+		return nil, "ID token nonce does not match the one of this session"
+	}
 	accessToken, ok := token.Extra("access_token").(string)
 	if !ok {
 		return nil, "no access_token in token response"
 	}
+	token.AccessToken = accessToken
+	tokenData, err = app.newTokenData(ctx, d, token, rawIDToken, idToken)
+	if err != nil {
+		return nil, err.Error()
+	}
+	return tokenData, ""
+}
+
+// newTokenData build the TokenData from a token response and its verified ID token. UserInfo are merged if configured so.
+func (app *OidcApp) newTokenData(ctx context.Context, d *discovery, token *oauth2.Token, rawIDToken string, idToken *oidc.IDToken) (*TokenData, error) {
 	var claims json.RawMessage
 	if err := idToken.Claims(&claims); err != nil {
-		return nil, fmt.Sprintf("error decoding ID token claims: %v", err)
+		return nil, fmt.Errorf("error decoding ID token claims: %v", err)
 	}
+	if app.config.UseUserInfo {
+		var err error
+		if claims, err = app.mergeUserInfo(ctx, d, token, idToken.Subject, claims); err != nil {
+			return nil, err
+		}
+	}
+	acr, amr := authContext(idToken)
 	return &TokenData{
-		IDToken:      rawIDToken,
-		AccessToken:  accessToken,
-		RefreshToken: token.RefreshToken,
-		RedirectURL:  app.config.RedirectURL,
-		Claims:       string(claims),
-	}, ""
+		IDToken:       rawIDToken,
+		AccessToken:   token.AccessToken,
+		RefreshToken:  token.RefreshToken,
+		Expiry:        token.Expiry,
+		IDTokenExpiry: idToken.Expiry,
+		Subject:       idToken.Subject,
+		Sid:           sessionID(idToken),
+		AuthTime:      authTime(idToken),
+		Acr:           acr,
+		Amr:           amr,
+		RedirectURL:   app.config.RedirectURL,
+		Claims:        string(claims),
+	}, nil
 }
@@ -0,0 +1,163 @@
+package oidcapp
+
+import (
+	"dexgate/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newTestApp build an app on a test issuer, once discovered. The connection and login settings are set on the provided configuration
+func newTestApp(t *testing.T, oidcConfig *config.OidcConfig) *OidcApp {
+	issuer, _ := newTestIssuer(t, nil)
+	oidcConfig.Name = "test"
+	oidcConfig.ClientID = "dexgate"
+	oidcConfig.IssuerURL = issuer.URL
+	oidcConfig.RedirectURL = "https://gate/dg_callback"
+	oidcConfig.ResponseMode = "query"
+	if oidcConfig.PKCE == nil {
+		pkce := true
+		oidcConfig.PKCE = &pkce
+	}
+	app, err := NewOidcApp(oidcConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(app.Close)
+	waitFor(t, app.Ready)
+	return app
+}
+
+func TestPKCE(t *testing.T) {
+	tests := []struct {
+		name      string
+		pkce      bool
+		verifier  string
+		challenge string // Empty if no challenge must be sent
+	}{
+		// Challenge computed with: printf <verifier> | openssl dgst -sha256 -binary | base64 | tr '+/' '-_' | tr -d '='
+		{"S256", true, "dBjftJeZ4CVP-mJ92ZXTQ5Qp1VoeNpNTzt5JD1ykK0Ci", "7q8n5MRsichThkb2na27mBHbQybP2VfaRX_3ErDmxJ4"},
+		{"disabled", false, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pkce := test.pkce
+			app := newTestApp(t, &config.OidcConfig{PKCE: &pkce})
+
+			loginContext, err := app.NewLoginContext()
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, _ := app.NewLoginContext()
+			if test.pkce && (len(loginContext.CodeVerifier) != 43 || loginContext.CodeVerifier == other.CodeVerifier) {
+				t.Errorf("expected a random 43 characters verifier, got '%s'", loginContext.CodeVerifier)
+			} else if !test.pkce && loginContext.CodeVerifier != "" {
+				t.Errorf("expected no verifier, got '%s'", loginContext.CodeVerifier)
+			}
+
+			loginContext.CodeVerifier = test.verifier
+			loginURL, err := app.NewLoginURL(loginContext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(loginURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			query := u.Query()
+			if query.Get("code_challenge") != test.challenge {
+				t.Errorf("expected challenge '%s', got '%s'", test.challenge, query.Get("code_challenge"))
+			}
+			method := ""
+			if test.challenge != "" {
+				method = "S256"
+			}
+			if query.Get("code_challenge_method") != method {
+				t.Errorf("expected challenge method '%s', got '%s'", method, query.Get("code_challenge_method"))
+			}
+			if test.verifier != "" && strings.Contains(loginURL, test.verifier) {
+				t.Errorf("the verifier is disclosed in the login URL: %s", loginURL)
+			}
+		})
+	}
+}
+
+// A session without verifier can't complete a login requiring PKCE. The code is not even exchanged
+func TestPKCEMissingVerifier(t *testing.T) {
+	app := newTestApp(t, &config.OidcConfig{})
+	r := httptest.NewRequest(http.MethodGet, "/dg_callback?code=code&state=state", nil)
+	if _, errMsg := app.HandleCallbackRequest(r, "code", &LoginContext{State: "state", Nonce: "nonce"}); !strings.Contains(errMsg, "no PKCE code verifier") {
+		t.Errorf("expected a missing verifier error, got '%s'", errMsg)
+	}
+}
+
+func TestAuthParams(t *testing.T) {
+	app := newTestApp(t, &config.OidcConfig{
+		ExtraAuthParams:       map[string]string{"kc_idp_hint": "corp", "ui_locales": "en"},
+		AuthParamsPassthrough: []string{"login_hint", "ui_locales"},
+	})
+	tests := []struct {
+		name     string
+		query    string
+		stepUp   map[string]string // As set by a step-up rule
+		expected map[string]string // Expected in the login URL. An empty value means absent
+	}{
+		{
+			name:     "configured parameters",
+			query:    "x=1",
+			expected: map[string]string{"kc_idp_hint": "corp", "ui_locales": "en", "login_hint": "", "x": ""},
+		},
+		{
+			name:     "passthrough parameters",
+			query:    "login_hint=john&ui_locales=fr&ui_locales=de&nonce=replayed&prompt=none",
+			expected: map[string]string{"kc_idp_hint": "corp", "ui_locales": "fr", "login_hint": "john", "prompt": ""},
+		},
+		{
+			name:     "empty passthrough parameter",
+			query:    "ui_locales=",
+			expected: map[string]string{"ui_locales": "en"},
+		},
+		{
+			name:     "step-up parameters",
+			query:    "login_hint=john",
+			stepUp:   map[string]string{"acr_values": "mfa", "prompt": "login"},
+			expected: map[string]string{"login_hint": "john", "acr_values": "mfa", "prompt": "login"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, err := url.ParseQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			loginContext, err := app.NewLoginContext()
+			if err != nil {
+				t.Fatal(err)
+			}
+			loginContext.AuthParams = app.PassthroughAuthParams(query)
+			for name, value := range test.stepUp {
+				loginContext.AuthParams[name] = value
+			}
+			loginURL, err := app.NewLoginURL(loginContext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(loginURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			params := u.Query()
+			for name, value := range test.expected {
+				if params.Get(name) != value {
+					t.Errorf("%s: expected '%s', got '%s'", name, value, params.Get(name))
+				}
+			}
+			// Parameters managed by dexgate are never overridden
+			if params.Get("state") != loginContext.State || params.Get("nonce") != loginContext.Nonce || params.Get("client_id") != "dexgate" {
+				t.Errorf("unexpected login URL: %s", loginURL)
+			}
+		})
+	}
+}
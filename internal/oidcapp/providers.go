@@ -0,0 +1,83 @@
+package oidcapp
+
+import (
+	"dexgate/internal/config"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Providers is the set of configured OIDC providers, in configuration order.
+type Providers struct {
+	list     []*OidcApp
+	byName   map[string]*OidcApp
+	byIssuer map[string]*OidcApp
+}
+
+// NewProviders instantiate an OidcApp for each of the provided configurations.
+func NewProviders(oidcConfigs []config.OidcConfig) (*Providers, error) {
+	providers := &Providers{
+		byName:   make(map[string]*OidcApp),
+		byIssuer: make(map[string]*OidcApp),
+	}
+	for i := range oidcConfigs {
+		app, err := NewOidcApp(&oidcConfigs[i])
+		if err != nil {
+			return nil, fmt.Errorf("provider '%s': %w", oidcConfigs[i].Name, err)
+		}
+		if _, ok := providers.byIssuer[app.IssuerURL()]; ok {
+			return nil, fmt.Errorf("provider '%s': issuer '%s' is already used by another provider", app.Name(), app.IssuerURL())
+		}
+		providers.list = append(providers.list, app)
+		providers.byName[app.Name()] = app
+		providers.byIssuer[app.IssuerURL()] = app
+	}
+	return providers, nil
+}
+
+// Close stop the background tasks of all providers
+func (p *Providers) Close() {
+	for _, app := range p.list {
+		app.Close()
+	}
+}
+
+// List return all providers, in configuration order.
+func (p *Providers) List() []*OidcApp {
+	return p.list
+}
+
+// Get return the provider of the given name. nil if unknown
+func (p *Providers) Get(name string) *OidcApp {
+	return p.byName[name]
+}
+
+// GetByIssuer return the provider of the given issuer URL. nil if unknown
+func (p *Providers) GetByIssuer(issuer string) *OidcApp {
+	return p.byIssuer[issuer]
+}
+
+// ForToken return the provider which issued the given JWT, based on its 'iss' claim.
+// NB: The token is NOT verified here. This is only a way to select the verifier.
+func (p *Providers) ForToken(rawToken string) (*OidcApp, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed jwt, expected 3 parts got %d", len(parts))
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt payload: %v", err)
+	}
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal jwt claims: %v", err)
+	}
+	app := p.GetByIssuer(claims.Issuer)
+	if app == nil {
+		return nil, fmt.Errorf("token issuer '%s' is not one of the configured providers", claims.Issuer)
+	}
+	return app, nil
+}
@@ -0,0 +1,136 @@
+package oidcapp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"sync"
+	"time"
+)
+
+// ErrRefreshRejected is returned when the OIDC server refuse to renew the token.
+// Typically, the user has been disabled or the refresh token has been revoked.
+var ErrRefreshRejected = errors.New("token renewal rejected by the OIDC server")
+
+// How long the result of a renewal is kept, to be shared with concurrent requests of the same session
+const refreshResultRetention = 30 * time.Second
+
+// Maximum duration of a renewal. It is not bound to the requests waiting for it, as they share its result
+const refreshTimeout = 1 * time.Minute
+
+// RefreshToken renew the tokens by using the refresh token. subject is the one of the session, which the renewed identity must match.
+// If the OIDC server provide a new ID token, the returned Claims are the new ones. Otherwise, Claims is empty.
+func (app *OidcApp) RefreshToken(ctx context.Context, refreshToken string, subject string) (*TokenData, error) {
+	return app.refreshes.do(ctx, refreshToken, func() (*TokenData, error) {
+		// Detached from the first caller: If it disconnects, the other requests waiting for this renewal must not fail
+		ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+		defer cancel()
+		tokenData, err := app.refreshToken(ctx, refreshToken)
+		if err == nil && subject != "" && tokenData.Subject != "" && tokenData.Subject != subject {
+			// See https://openid.net/specs/openid-connect-core-1_0.html#RefreshTokenResponse
+			return nil, fmt.Errorf("%w: renewed identity subject '%s' does not match the session one '%s'", ErrRefreshRejected, tokenData.Subject, subject)
+		}
+		return tokenData, err
+	})
+}
+
+func (app *OidcApp) refreshToken(ctx context.Context, refreshToken string) (*TokenData, error) {
+	d, err := app.current()
+	if err != nil {
+		return nil, err
+	}
+	token, err := app.oauth2Config(d, nil).TokenSource(oidc.ClientContext(ctx, app.authClient), &oauth2.Token{RefreshToken: refreshToken}).Token()
+	ctx = oidc.ClientContext(ctx, app.client)
+	if err != nil {
+		var retrieveError *oauth2.RetrieveError
+		if errors.As(err, &retrieveError) && retrieveError.Response != nil && retrieveError.Response.StatusCode >= 400 && retrieveError.Response.StatusCode < 500 {
+			return nil, fmt.Errorf("%w: %v", ErrRefreshRejected, err)
+		}
+		return nil, fmt.Errorf("failed to refresh token: %v", err)
+	}
+	tokenData := &TokenData{
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		Expiry:       token.Expiry,
+		RedirectURL:  app.config.RedirectURL,
+	}
+	if app.isOAuth2() {
+		// No ID token. The user information are fetched again instead, so group changes are taken into account
+		return app.newOAuth2TokenData(ctx, token)
+	}
+	// ID token is optional in a refresh response (OIDC core, section 12.2)
+	if rawIDToken, ok := token.Extra("id_token").(string); ok {
+		idToken, err := app.verifyIDToken(ctx, d, rawIDToken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify refreshed ID token: %v", err)
+		}
+		var claims json.RawMessage
+		if err := idToken.Claims(&claims); err != nil {
+			return nil, fmt.Errorf("error decoding refreshed ID token claims: %v", err)
+		}
+		if app.config.UseUserInfo {
+			if claims, err = app.mergeUserInfo(ctx, d, token, idToken.Subject, claims); err != nil {
+				return nil, err
+			}
+		}
+		tokenData.IDToken = rawIDToken
+		tokenData.IDTokenExpiry = idToken.Expiry
+		tokenData.Subject = idToken.Subject
+		tokenData.Sid = sessionID(idToken)
+		tokenData.AuthTime = authTime(idToken)
+		tokenData.Claims = string(claims)
+	}
+	return tokenData, nil
+}
+
+// refreshGroup ensure there is only one renewal in flight for a given refresh token.
+// Most OIDC servers invalidate a refresh token once used. So, concurrent requests of the same session
+// must wait for the pending renewal and share its result.
+// The renewal runs in its own goroutine: A caller giving up (ctx done) does not abort it for the others.
+type refreshGroup struct {
+	mutex sync.Mutex
+	calls map[string]*refreshCall
+}
+
+type refreshCall struct {
+	done      chan struct{}
+	tokenData *TokenData
+	err       error
+	expiry    time.Time
+}
+
+func (g *refreshGroup) do(ctx context.Context, refreshToken string, refresh func() (*TokenData, error)) (*TokenData, error) {
+	g.mutex.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*refreshCall)
+	}
+	now := time.Now()
+	for key, call := range g.calls {
+		if !call.expiry.IsZero() && now.After(call.expiry) {
+			delete(g.calls, key)
+		}
+	}
+	call, ok := g.calls[refreshToken]
+	if !ok {
+		call = &refreshCall{done: make(chan struct{})}
+		g.calls[refreshToken] = call
+		go func() {
+			tokenData, err := refresh()
+			g.mutex.Lock()
+			call.tokenData, call.err = tokenData, err
+			call.expiry = time.Now().Add(refreshResultRetention)
+			g.mutex.Unlock()
+			close(call.done)
+		}()
+	}
+	g.mutex.Unlock()
+	select {
+	case <-call.done:
+		return call.tokenData, call.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("failed to refresh token: %v", ctx.Err())
+	}
+}
@@ -0,0 +1,57 @@
+package oidcapp
+
+import (
+	"bytes"
+	"dexgate/internal/config"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// staticDiscoveryTransport serve a discovery document built from the oidc.endpoints configuration, for OIDC servers not providing one.
+// So, the provider is built as usual, but without querying the OIDC server. All other requests (keys, token, ...) are sent to the OIDC server.
+type staticDiscoveryTransport struct {
+	wellKnownURL string
+	document     []byte
+	base         http.RoundTripper
+}
+
+func newStaticDiscoveryTransport(oidcConfig *config.OidcConfig, base http.RoundTripper) (*staticDiscoveryTransport, error) {
+	endpoints := oidcConfig.Endpoints
+	document, err := json.Marshal(map[string]interface{}{
+		"issuer":                                oidcConfig.IssuerURL,
+		"authorization_endpoint":                endpoints.Authorization,
+		"token_endpoint":                        endpoints.Token,
+		"userinfo_endpoint":                     endpoints.UserInfo,
+		"jwks_uri":                              endpoints.JWKS,
+		"id_token_signing_alg_values_supported": endpoints.SigningAlgs,
+		"scopes_supported":                      endpoints.ScopesSupported,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &staticDiscoveryTransport{
+		// As built by oidc.NewProvider()
+		wellKnownURL: strings.TrimSuffix(oidcConfig.IssuerURL, "/") + "/.well-known/openid-configuration",
+		document:     document,
+		base:         base,
+	}, nil
+}
+
+func (t *staticDiscoveryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || req.URL.String() != t.wellKnownURL {
+		return t.base.RoundTrip(req)
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(t.document)),
+		ContentLength: int64(len(t.document)),
+		Request:       req,
+	}, nil
+}
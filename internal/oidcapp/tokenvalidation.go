@@ -0,0 +1,94 @@
+package oidcapp
+
+import (
+	"context"
+	"fmt"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"time"
+)
+
+// verifierConfig complete a go-oidc verifier configuration with the provider token validation settings.
+func (app *OidcApp) verifierConfig(verifierConfig oidc.Config) *oidc.Config {
+	tokenValidation := &app.config.TokenValidation
+	// If empty, the provider supported algorithms are used
+	verifierConfig.SupportedSigningAlgs = tokenValidation.SigningAlgs
+	// go-oidc has no tolerance on expiration. The check is then performed by checkExpiry()
+	if tokenValidation.ClockSkewDuration > 0 {
+		verifierConfig.SkipExpiryCheck = true
+	}
+	return &verifierConfig
+}
+
+// checkExpiry check the token expiration and 'nbf' claim with the clock skew tolerance, if the verifier skipped it (See verifierConfig()).
+func (app *OidcApp) checkExpiry(token *oidc.IDToken) error {
+	skew := app.config.TokenValidation.ClockSkewDuration
+	if skew == 0 {
+		return nil
+	}
+	now := time.Now()
+	if now.Add(-skew).After(token.Expiry) {
+		return fmt.Errorf("oidc: token is expired (Token Expiry: %v)", token.Expiry)
+	}
+	var claims struct {
+		NotBefore float64 `json:"nbf"`
+	}
+	if err := token.Claims(&claims); err != nil {
+		return fmt.Errorf("error decoding token claims: %v", err)
+	}
+	// Same one minute leeway as go-oidc
+	if notBefore := time.Unix(int64(claims.NotBefore), 0); claims.NotBefore != 0 && now.Add(time.Minute+skew).Before(notBefore) {
+		return fmt.Errorf("oidc: current time %v before the nbf (not before) time: %v", now, notBefore)
+	}
+	return nil
+}
+
+// verifyIDToken validate an ID token signature, issuer and expiration, then its audience and authorized party,
+// as defined in https://openid.net/specs/openid-connect-core-1_0.html#IDTokenValidation (Steps 3 to 5).
+func (app *OidcApp) verifyIDToken(ctx context.Context, d *discovery, rawIDToken string) (*oidc.IDToken, error) {
+	idToken, err := d.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if err := app.checkExpiry(idToken); err != nil {
+		return nil, err
+	}
+	clientID := app.config.ClientID
+	audiences := append([]string{clientID}, app.config.TokenValidation.Audiences...)
+	if !ContainsOneOf(idToken.Audience, audiences) {
+		return nil, fmt.Errorf("ID token audience %q does not match any of the accepted ones %q", idToken.Audience, audiences)
+	}
+	var claims struct {
+		Azp string `json:"azp"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("error decoding ID token claims: %v", err)
+	}
+	// Issued for another client (i.e. a cross-client peer). Only the azp claim tells it was requested by us
+	mustHaveAzp := app.config.TokenValidation.RequireAuthorizedParty || !ContainsOneOf(idToken.Audience, []string{clientID})
+	if err := checkAuthorizedParty(claims.Azp, mustHaveAzp, app.authorizedParties()); err != nil {
+		return nil, fmt.Errorf("ID token %v", err)
+	}
+	return idToken, nil
+}
+
+// authorizedParties return the accepted 'azp' values
+func (app *OidcApp) authorizedParties() []string {
+	if len(app.config.TokenValidation.AuthorizedParties) > 0 {
+		return app.config.TokenValidation.AuthorizedParties
+	}
+	return []string{app.config.ClientID}
+}
+
+// checkAuthorizedParty check an 'azp' claim value, if any
+func checkAuthorizedParty(azp string, required bool, authorizedParties []string) error {
+	if azp == "" {
+		if required {
+			return fmt.Errorf("has no azp claim")
+		}
+		return nil
+	}
+	if !ContainsOneOf([]string{azp}, authorizedParties) {
+		return fmt.Errorf("azp %q is not one of the authorized parties %q", azp, authorizedParties)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package oidcapp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"dexgate/internal/config"
+	"dexgate/pkg/configwatcher"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often the certificate files are checked for change
+const transportFilesPollInterval = 30 * time.Second
+
+// reloadingTransport is an http.RoundTripper to the OIDC server, built from the oidc.transport configuration.
+// On certificate files change, a new http.Transport is built and replace the current one.
+type reloadingTransport struct {
+	name       string
+	rootCAFile string
+	config     *config.TransportConfig
+	mutex      sync.RWMutex
+	current    *http.Transport
+	watchers   []configwatcher.ConfigWatcher
+}
+
+func newReloadingTransport(oidcConfig *config.OidcConfig) (*reloadingTransport, error) {
+	t := &reloadingTransport{
+		name:       oidcConfig.Name,
+		rootCAFile: oidcConfig.RootCAFile,
+		config:     &oidcConfig.Transport,
+	}
+	transport, err := t.build()
+	if err != nil {
+		return nil, err
+	}
+	t.current = transport
+	for _, file := range t.files() {
+		watcher, err := configwatcher.NewPollingFileWatcher(file, transportFilesPollInterval, config.Log)
+		if err != nil {
+			return nil, err
+		}
+		// Initial content, as reference for change detection
+		if _, err := watcher.Get(); err != nil {
+			return nil, err
+		}
+		if err := watcher.Watch(func(string) { t.reload() }); err != nil {
+			return nil, err
+		}
+		t.watchers = append(t.watchers, watcher)
+	}
+	return t, nil
+}
+
+// files return all the certificate files to watch
+func (t *reloadingTransport) files() []string {
+	files := make([]string, 0, len(t.config.CAFiles)+3)
+	if t.rootCAFile != "" {
+		files = append(files, t.rootCAFile)
+	}
+	files = append(files, t.config.CAFiles...)
+	if t.config.ClientCertFile != "" {
+		files = append(files, t.config.ClientCertFile, t.config.ClientKeyFile)
+	}
+	return files
+}
+
+func (t *reloadingTransport) reload() {
+	transport, err := t.build()
+	if err != nil {
+		// May be transient, if the certificate and the key are not updated at the same time. Next change will fix.
+		config.Log.Errorf("Provider '%s': Error on reloading transport certificates: %v. Keep old version", t.name, err)
+		return
+	}
+	t.mutex.Lock()
+	old := t.current
+	t.current = transport
+	t.mutex.Unlock()
+	old.CloseIdleConnections()
+	config.Log.Infof("Provider '%s': transport certificates reloaded", t.name)
+}
+
+func (t *reloadingTransport) build() (*http.Transport, error) {
+	tlsConfig := &tls.Config{}
+	if t.rootCAFile != "" || len(t.config.CAFiles) > 0 {
+		var pool *x509.CertPool
+		if t.rootCAFile != "" {
+			// For compatibility, rootCAFile replaces the system CAs
+			pool = x509.NewCertPool()
+			if err := appendCAFile(pool, t.rootCAFile); err != nil {
+				return nil, err
+			}
+		} else {
+			var err error
+			if pool, err = x509.SystemCertPool(); err != nil {
+				config.Log.Warnf("Provider '%s': unable to load system CAs: %v", t.name, err)
+				pool = x509.NewCertPool()
+			}
+		}
+		for _, caFile := range t.config.CAFiles {
+			if err := appendCAFile(pool, caFile); err != nil {
+				return nil, err
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if t.config.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.config.ClientCertFile, t.config.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate '%s': %v", t.config.ClientCertFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	proxy := http.ProxyFromEnvironment
+	if t.config.Proxy != nil {
+		proxy = http.ProxyURL(t.config.Proxy)
+	}
+	return &http.Transport{
+		TLSClientConfig: tlsConfig,
+		Proxy:           proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   t.config.DialDuration,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   t.config.TLSDuration,
+		ResponseHeaderTimeout: t.config.ResponseDuration,
+		ExpectContinueTimeout: 1 * time.Second,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+	}, nil
+}
+
+func appendCAFile(pool *x509.CertPool, caFile string) error {
+	caBytes, err := os.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("failed to read CA file: %v", err)
+	}
+	if !pool.AppendCertsFromPEM(caBytes) {
+		return fmt.Errorf("no certs found in CA file %q", caFile)
+	}
+	config.Log.Infof("CA file '%s' loaded successfully.", caFile)
+	return nil
+}
+
+func (t *reloadingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mutex.RLock()
+	transport := t.current
+	t.mutex.RUnlock()
+	return transport.RoundTrip(req)
+}
@@ -0,0 +1,61 @@
+package oidcapp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/oauth2"
+)
+
+// Claims which are related to the authentication event. So, never taken from UserInfo
+var idTokenOnlyClaims = map[string]bool{
+	"iss":       true,
+	"sub":       true,
+	"aud":       true,
+	"exp":       true,
+	"iat":       true,
+	"nbf":       true,
+	"jti":       true,
+	"nonce":     true,
+	"auth_time": true,
+	"sid":       true,
+	"azp":       true,
+	"acr":       true,
+	"amr":       true,
+	"at_hash":   true,
+	"c_hash":    true,
+}
+
+// mergeUserInfo fetch the UserInfo of the user and merge them in the ID token claims.
+// If a claim is present in both, the value is taken from the source defined by oidc.userInfoPrecedence
+func (app *OidcApp) mergeUserInfo(ctx context.Context, d *discovery, token *oauth2.Token, subject string, idTokenClaims []byte) ([]byte, error) {
+	userInfo, err := d.provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get UserInfo: %v", err)
+	}
+	// See https://openid.net/specs/openid-connect-core-1_0.html#UserInfoResponse
+	if userInfo.Subject != subject {
+		return nil, fmt.Errorf("UserInfo subject '%s' does not match the ID token one '%s'", userInfo.Subject, subject)
+	}
+	var userInfoClaims map[string]interface{}
+	if err := userInfo.Claims(&userInfoClaims); err != nil {
+		return nil, fmt.Errorf("error decoding UserInfo claims: %v", err)
+	}
+	claims := make(map[string]interface{})
+	decoder := json.NewDecoder(bytes.NewReader(idTokenClaims))
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, fmt.Errorf("error decoding ID token claims: %v", err)
+	}
+	for name, value := range userInfoClaims {
+		if idTokenOnlyClaims[name] {
+			continue
+		}
+		if _, ok := claims[name]; ok && app.config.UserInfoPrecedence != "userInfo" {
+			continue
+		}
+		claims[name] = value
+	}
+	return json.Marshal(claims)
+}
@@ -0,0 +1,67 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter count the requests of each client over a fixed window, and refuse them beyond a limit.
+// The number of tracked clients is bounded: When full, requests from new clients are refused up to the expiry of some windows.
+type Limiter struct {
+	mutex      sync.Mutex
+	limit      int
+	window     time.Duration
+	maxClients int
+	clients    map[string]*clientWindow
+}
+
+type clientWindow struct {
+	end   time.Time
+	count int
+}
+
+// NewLimiter allow limit requests per window to each client, for up to maxClients clients at once
+func NewLimiter(limit int, window time.Duration, maxClients int) *Limiter {
+	return &Limiter{
+		limit:      limit,
+		window:     window,
+		maxClients: maxClients,
+		clients:    make(map[string]*clientWindow),
+	}
+}
+
+// Allow tell if the client request may proceed. If not, also return the delay after which the client may retry.
+func (l *Limiter) Allow(client string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	current, ok := l.clients[client]
+	if ok && !now.Before(current.end) {
+		delete(l.clients, client)
+		ok = false
+	}
+	if !ok {
+		if len(l.clients) >= l.maxClients {
+			l.prune(now)
+			if len(l.clients) >= l.maxClients {
+				return false, l.window
+			}
+		}
+		current = &clientWindow{end: now.Add(l.window)}
+		l.clients[client] = current
+	}
+	if current.count >= l.limit {
+		return false, current.end.Sub(now)
+	}
+	current.count++
+	return true, 0
+}
+
+// prune remove the expired windows. Must be called with the mutex held
+func (l *Limiter) prune(now time.Time) {
+	for client, current := range l.clients {
+		if !now.Before(current.end) {
+			delete(l.clients, client)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	limiter := NewLimiter(2, 50*time.Millisecond, 2)
+	tests := []struct {
+		client  string
+		allowed bool
+	}{
+		{"10.0.0.1", true},
+		{"10.0.0.1", true},
+		{"10.0.0.1", false},
+		{"10.0.0.2", true},
+		// Too many clients
+		{"10.0.0.3", false},
+		{"10.0.0.2", true},
+		{"10.0.0.2", false},
+	}
+	for i, test := range tests {
+		allowed, retryAfter := limiter.Allow(test.client)
+		if allowed != test.allowed {
+			t.Fatalf("request %d from %s: expected allowed=%v", i, test.client, test.allowed)
+		}
+		if !allowed && (retryAfter <= 0 || retryAfter > 50*time.Millisecond) {
+			t.Errorf("request %d from %s: unexpected retry delay %s", i, test.client, retryAfter)
+		}
+	}
+
+	// Once the windows expired, new clients are accepted again
+	time.Sleep(60 * time.Millisecond)
+	for _, client := range []string{"10.0.0.3", "10.0.0.1", "10.0.0.1"} {
+		if allowed, _ := limiter.Allow(client); !allowed {
+			t.Errorf("request from %s: expected to be allowed after the window expiry", client)
+		}
+	}
+	if allowed, _ := limiter.Allow("10.0.0.2"); allowed {
+		t.Errorf("request from 10.0.0.2: expected to be refused, as 2 clients are tracked")
+	}
+}
@@ -0,0 +1,133 @@
+package samlapp
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"github.com/beevik/etree"
+	validator "github.com/mattermost/xml-roundtrip-validator"
+	dsig "github.com/russellhaering/goxmldsig"
+	"strings"
+)
+
+// idpMetadata is what we need from the IdP metadata
+type idpMetadata struct {
+	entityID                string
+	certs                   []*x509.Certificate // Signing certificates
+	ssoURLs                 map[string]string   // SingleSignOnService location, by binding
+	wantAuthnRequestsSigned bool
+}
+
+// The part of the SAML metadata we are interested in.
+// See https://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf
+type entityDescriptor struct {
+	XMLName          xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityID         string   `xml:"entityID,attr"`
+	IDPSSODescriptor *struct {
+		WantAuthnRequestsSigned bool `xml:"WantAuthnRequestsSigned,attr"`
+		KeyDescriptors          []struct {
+			Use          string   `xml:"use,attr"`
+			Certificates []string `xml:"http://www.w3.org/2000/09/xmldsig# KeyInfo>X509Data>X509Certificate"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:metadata KeyDescriptor"`
+		SingleSignOnServices []struct {
+			Binding  string `xml:"Binding,attr"`
+			Location string `xml:"Location,attr"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:metadata SingleSignOnService"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:metadata IDPSSODescriptor"`
+}
+
+type entitiesDescriptor struct {
+	XMLName           xml.Name           `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntitiesDescriptor"`
+	EntityDescriptors []entityDescriptor `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+}
+
+// parseIdpMetadata parse the IdP metadata. It may be an EntityDescriptor, or an EntitiesDescriptor
+// from which the first IdP is retained.
+func parseIdpMetadata(data []byte) (*idpMetadata, error) {
+	if err := validator.Validate(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	var entity *entityDescriptor
+	var single entityDescriptor
+	if err := xml.Unmarshal(data, &single); err == nil {
+		entity = &single
+	} else {
+		var aggregate entitiesDescriptor
+		if err := xml.Unmarshal(data, &aggregate); err != nil {
+			return nil, fmt.Errorf("neither an EntityDescriptor nor an EntitiesDescriptor: %v", err)
+		}
+		for i := range aggregate.EntityDescriptors {
+			if aggregate.EntityDescriptors[i].IDPSSODescriptor != nil {
+				entity = &aggregate.EntityDescriptors[i]
+				break
+			}
+		}
+	}
+	if entity == nil || entity.IDPSSODescriptor == nil {
+		return nil, fmt.Errorf("no IDPSSODescriptor found")
+	}
+	if entity.EntityID == "" {
+		return nil, fmt.Errorf("no entityID")
+	}
+	idp := &idpMetadata{
+		entityID:                entity.EntityID,
+		ssoURLs:                 make(map[string]string),
+		wantAuthnRequestsSigned: entity.IDPSSODescriptor.WantAuthnRequestsSigned,
+	}
+	for _, keyDescriptor := range entity.IDPSSODescriptor.KeyDescriptors {
+		if keyDescriptor.Use != "" && keyDescriptor.Use != "signing" {
+			continue
+		}
+		for _, data := range keyDescriptor.Certificates {
+			der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(data), ""))
+			if err != nil {
+				return nil, fmt.Errorf("invalid X509Certificate: %v", err)
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, fmt.Errorf("invalid X509Certificate: %v", err)
+			}
+			idp.certs = append(idp.certs, cert)
+		}
+	}
+	if len(idp.certs) == 0 {
+		return nil, fmt.Errorf("no signing certificate found")
+	}
+	for _, sso := range entity.IDPSSODescriptor.SingleSignOnServices {
+		if _, ok := idp.ssoURLs[sso.Binding]; !ok {
+			idp.ssoURLs[sso.Binding] = sso.Location
+		}
+	}
+	return idp, nil
+}
+
+// Metadata return the SP metadata, to be registered in the IdP
+func (app *SamlApp) Metadata() ([]byte, error) {
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	entity := doc.CreateElement("md:EntityDescriptor")
+	entity.CreateAttr("xmlns:md", metadataNS)
+	entity.CreateAttr("entityID", app.config.EntityID)
+	sp := entity.CreateElement("md:SPSSODescriptor")
+	sp.CreateAttr("AuthnRequestsSigned", fmt.Sprintf("%t", app.signer != nil))
+	sp.CreateAttr("protocolSupportEnumeration", protocolNS)
+	if app.cert != nil {
+		keyDescriptor := sp.CreateElement("md:KeyDescriptor")
+		keyDescriptor.CreateAttr("use", "signing")
+		keyInfo := keyDescriptor.CreateElement("ds:KeyInfo")
+		keyInfo.CreateAttr("xmlns:ds", dsig.Namespace)
+		keyInfo.CreateElement("ds:X509Data").CreateElement("ds:X509Certificate").SetText(base64.StdEncoding.EncodeToString(app.cert))
+	}
+	if app.config.NameIDFormat != "" {
+		sp.CreateElement("md:NameIDFormat").SetText(app.config.NameIDFormat)
+	}
+	acs := sp.CreateElement("md:AssertionConsumerService")
+	acs.CreateAttr("Binding", postBinding)
+	acs.CreateAttr("Location", app.acsURL)
+	acs.CreateAttr("index", "0")
+	acs.CreateAttr("isDefault", "true")
+	doc.Indent(2)
+	return doc.WriteToBytes()
+}
@@ -0,0 +1,311 @@
+package samlapp
+
+import (
+	"bytes"
+	"dexgate/internal/identity"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/beevik/etree"
+	validator "github.com/mattermost/xml-roundtrip-validator"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/russellhaering/goxmldsig/etreeutils"
+	"net/http"
+	"time"
+)
+
+// Tolerated clock difference with the IdP, when checking the assertion validity period
+const clockSkew = 1 * time.Minute
+
+const (
+	statusSuccess      = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	bearerConfirmation = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+)
+
+// The part of the Response we are interested in. See https://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
+type response struct {
+	Destination  string `xml:"Destination,attr"`
+	InResponseTo string `xml:"InResponseTo,attr"`
+	Issuer       string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Status       struct {
+		StatusCode struct {
+			Value      string `xml:"Value,attr"`
+			StatusCode *struct {
+				Value string `xml:"Value,attr"`
+			} `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusCode"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusCode"`
+		StatusMessage string `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusMessage"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
+}
+
+type assertion struct {
+	ID      string `xml:"ID,attr"`
+	Issuer  string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Subject struct {
+		NameID               string `xml:"urn:oasis:names:tc:SAML:2.0:assertion NameID"`
+		SubjectConfirmations []struct {
+			Method string `xml:"Method,attr"`
+			Data   struct {
+				NotOnOrAfter time.Time `xml:"NotOnOrAfter,attr"`
+				Recipient    string    `xml:"Recipient,attr"`
+				InResponseTo string    `xml:"InResponseTo,attr"`
+			} `xml:"urn:oasis:names:tc:SAML:2.0:assertion SubjectConfirmationData"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:assertion SubjectConfirmation"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:assertion Subject"`
+	Conditions *struct {
+		NotBefore            time.Time `xml:"NotBefore,attr"`
+		NotOnOrAfter         time.Time `xml:"NotOnOrAfter,attr"`
+		AudienceRestrictions []struct {
+			Audiences []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Audience"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:assertion AudienceRestriction"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:assertion Conditions"`
+	AuthnStatement *struct {
+		AuthnInstant        time.Time `xml:"AuthnInstant,attr"`
+		SessionIndex        string    `xml:"SessionIndex,attr"`
+		SessionNotOnOrAfter time.Time `xml:"SessionNotOnOrAfter,attr"`
+		ClassRef            string    `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnContext>AuthnContextClassRef"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnStatement"`
+	Attributes []struct {
+		Name         string   `xml:"Name,attr"`
+		FriendlyName string   `xml:"FriendlyName,attr"`
+		Values       []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion AttributeValue"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:assertion AttributeStatement>Attribute"`
+}
+
+// LoginData is the user authentication, as asserted by the IdP
+type LoginData struct {
+	Subject       string    // The assertion NameID
+	SessionIndex  string    // The IdP session. Empty if not provided
+	AuthTime      time.Time // When the user authenticated (AuthnInstant)
+	Acr           string    // The authentication context class (AuthnContextClassRef). Empty if not provided
+	SessionExpiry time.Time // The IdP session end (SessionNotOnOrAfter). Zero if not provided
+	Claims        string    // JSON encoded user claims, as if provided by an OIDC server
+}
+
+// HandleResponse validate the SAML Response posted to the assertion consumer service, against the pending request.
+// An empty requestID means there is no pending login for this session.
+func (app *SamlApp) HandleResponse(r *http.Request, requestID string) (loginData *LoginData, errMsg string) {
+	if r.Method != http.MethodPost {
+		return nil, fmt.Sprintf("method not implemented: %s", r.Method)
+	}
+	encoded := r.PostFormValue("SAMLResponse")
+	if encoded == "" {
+		return nil, "no SAMLResponse in request"
+	}
+	if requestID == "" {
+		return nil, "no pending login for this session. The login request is unknown, already used or expired"
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Sprintf("unable to decode SAMLResponse: %v", err)
+	}
+	a, err := app.validateResponse(data, requestID, time.Now())
+	if err != nil {
+		return nil, fmt.Sprintf("invalid SAML response: %v", err)
+	}
+	loginData, err = app.newLoginData(a)
+	if err != nil {
+		return nil, err.Error()
+	}
+	return loginData, ""
+}
+
+// validateResponse check the response signature(s) and content. Return the validated assertion.
+// Only the signed elements, as returned by the signature validation, are taken into account.
+func (app *SamlApp) validateResponse(data []byte, requestID string, now time.Time) (*assertion, error) {
+	// Protect against XML round trip vulnerabilities in encoding/xml
+	if err := validator.Validate(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, fmt.Errorf("unable to parse XML: %v", err)
+	}
+	root := doc.Root()
+	if root == nil || root.Tag != "Response" || root.NamespaceURI() != protocolNS {
+		return nil, fmt.Errorf("not a SAML Response")
+	}
+	idp := app.currentIdp()
+	validationContext := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: idp.certs})
+
+	responseSigned := false
+	if signature, err := etreeutils.NSFindOneChild(root, dsig.Namespace, dsig.SignatureTag); err != nil {
+		return nil, err
+	} else if signature != nil {
+		if root, err = validationContext.Validate(root); err != nil {
+			return nil, fmt.Errorf("response signature: %v", err)
+		}
+		responseSigned = true
+	}
+	var resp response
+	if err := unmarshalElement(root, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Status.StatusCode.Value != statusSuccess {
+		status := resp.Status.StatusCode.Value
+		if resp.Status.StatusCode.StatusCode != nil {
+			status += " / " + resp.Status.StatusCode.StatusCode.Value
+		}
+		return nil, fmt.Errorf("login failed on IdP: %s %s", status, resp.Status.StatusMessage)
+	}
+	if resp.Destination != "" && resp.Destination != app.acsURL {
+		return nil, fmt.Errorf("destination '%s' is not '%s'", resp.Destination, app.acsURL)
+	}
+	if resp.InResponseTo != requestID {
+		return nil, fmt.Errorf("InResponseTo '%s' does not match the login request of this session", resp.InResponseTo)
+	}
+	if resp.Issuer != "" && resp.Issuer != idp.entityID {
+		return nil, fmt.Errorf("issuer '%s' is not '%s'", resp.Issuer, idp.entityID)
+	}
+
+	// Exactly one assertion is expected
+	var assertionEl *etree.Element
+	count := 0
+	err := etreeutils.NSFindChildrenIterateCtx(etreeutils.NewDefaultNSContext(), root, assertionNS, "Assertion", func(ctx etreeutils.NSContext, el *etree.Element) error {
+		count++
+		// Keep the namespaces declared by the ancestors, for the signature to be checked on the element alone
+		detached, err := etreeutils.NSDetatch(ctx, el)
+		assertionEl = detached
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if encrypted, _ := etreeutils.NSFindOneChild(root, assertionNS, "EncryptedAssertion"); encrypted != nil {
+		return nil, fmt.Errorf("encrypted assertions are not supported")
+	}
+	if count != 1 {
+		return nil, fmt.Errorf("%d assertions found. Exactly one is expected", count)
+	}
+	if signature, err := etreeutils.NSFindOneChild(assertionEl, dsig.Namespace, dsig.SignatureTag); err != nil {
+		return nil, err
+	} else if signature != nil {
+		if assertionEl, err = validationContext.Validate(assertionEl); err != nil {
+			return nil, fmt.Errorf("assertion signature: %v", err)
+		}
+	} else if !responseSigned {
+		return nil, fmt.Errorf("neither the response nor the assertion is signed")
+	}
+	var a assertion
+	if err := unmarshalElement(assertionEl, &a); err != nil {
+		return nil, err
+	}
+	if err := app.checkAssertion(&a, idp, requestID, now); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (app *SamlApp) checkAssertion(a *assertion, idp *idpMetadata, requestID string, now time.Time) error {
+	if a.Issuer != idp.entityID {
+		return fmt.Errorf("assertion issuer '%s' is not '%s'", a.Issuer, idp.entityID)
+	}
+	if a.Subject.NameID == "" {
+		return fmt.Errorf("no NameID in assertion")
+	}
+	// See https://docs.oasis-open.org/security/saml/v2.0/saml-profiles-2.0-os.pdf, section 4.1.4.2
+	confirmed := false
+	for _, confirmation := range a.Subject.SubjectConfirmations {
+		data := confirmation.Data
+		if confirmation.Method == bearerConfirmation && data.Recipient == app.acsURL && data.InResponseTo == requestID &&
+			!data.NotOnOrAfter.IsZero() && now.Before(data.NotOnOrAfter.Add(clockSkew)) {
+			confirmed = true
+			break
+		}
+	}
+	if !confirmed {
+		return fmt.Errorf("no valid bearer SubjectConfirmation for this login request")
+	}
+	// The assertion must also be restricted to our entity ID (same section)
+	if a.Conditions == nil || len(a.Conditions.AudienceRestrictions) == 0 {
+		return fmt.Errorf("no AudienceRestriction in assertion")
+	}
+	if !a.Conditions.NotBefore.IsZero() && now.Add(clockSkew).Before(a.Conditions.NotBefore) {
+		return fmt.Errorf("assertion is not yet valid (NotBefore: %s)", a.Conditions.NotBefore.String())
+	}
+	if !a.Conditions.NotOnOrAfter.IsZero() && !now.Before(a.Conditions.NotOnOrAfter.Add(clockSkew)) {
+		return fmt.Errorf("assertion has expired (NotOnOrAfter: %s)", a.Conditions.NotOnOrAfter.String())
+	}
+	// Each AudienceRestriction must include our entity ID
+	for _, restriction := range a.Conditions.AudienceRestrictions {
+		found := false
+		for _, audience := range restriction.Audiences {
+			found = found || audience == app.config.EntityID
+		}
+		if !found {
+			return fmt.Errorf("audience %q does not include '%s'", restriction.Audiences, app.config.EntityID)
+		}
+	}
+	if a.AuthnStatement == nil {
+		return fmt.Errorf("no AuthnStatement in assertion")
+	}
+	return nil
+}
+
+// newLoginData build the user claims from the assertion. The identity is stored under the claims mapping paths,
+// and the other claims with the same names as the OIDC ones. So, the user permissions and identity headers apply the same way.
+func (app *SamlApp) newLoginData(a *assertion) (*LoginData, error) {
+	attributes := app.config.Attributes
+	id := &identity.Identity{
+		Username: a.Subject.NameID,
+		Email:    firstValue(a.attributeValues(attributes.Email)),
+		Groups:   a.attributeValues(attributes.Groups),
+	}
+	if attributes.Name != "" {
+		id.Username = firstValue(a.attributeValues(attributes.Name))
+	}
+	id.EmailVerified = app.config.TrustEmail && id.Email != ""
+	claims := map[string]interface{}{
+		"iss":       a.Issuer,
+		"sub":       a.Subject.NameID,
+		"auth_time": a.AuthnStatement.AuthnInstant.Unix(),
+	}
+	app.mapping.ToClaims(id, claims)
+	if a.AuthnStatement.ClassRef != "" {
+		claims["acr"] = a.AuthnStatement.ClassRef
+	}
+	if a.AuthnStatement.SessionIndex != "" {
+		claims["sid"] = a.AuthnStatement.SessionIndex
+	}
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginData{
+		Subject:       a.Subject.NameID,
+		SessionIndex:  a.AuthnStatement.SessionIndex,
+		AuthTime:      a.AuthnStatement.AuthnInstant,
+		Acr:           a.AuthnStatement.ClassRef,
+		SessionExpiry: a.AuthnStatement.SessionNotOnOrAfter,
+		Claims:        string(data),
+	}, nil
+}
+
+// attributeValues return the values of the attribute of the given Name or FriendlyName. nil if not found
+func (a *assertion) attributeValues(name string) []string {
+	for _, attribute := range a.Attributes {
+		if attribute.Name == name || attribute.FriendlyName == name {
+			return attribute.Values
+		}
+	}
+	return nil
+}
+
+func firstValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// unmarshalElement decode an etree element with encoding/xml
+func unmarshalElement(el *etree.Element, v interface{}) error {
+	doc := etree.NewDocument()
+	doc.SetRoot(el.Copy())
+	data, err := doc.WriteToBytes()
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(data, v)
+}
@@ -0,0 +1,376 @@
+package samlapp
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"dexgate/internal/config"
+	"dexgate/internal/identity"
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testIdpEntityID = "https://idp.example.com/metadata"
+	testSpEntityID  = "https://sp.example.com/dg_saml/metadata"
+	testAcsURL      = "https://sp.example.com/dg_saml/acs"
+	testRequestID   = "_request42"
+)
+
+var testNow = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+type testSigner struct {
+	cert *x509.Certificate
+	ctx  *dsig.SigningContext
+}
+
+func newTestSigner(t *testing.T) *testSigner {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp.example.com"},
+		// The signature validation checks the certificate against the actual clock
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter:  time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := dsig.NewDefaultSigningContext(dsig.TLSCertKeyStore{PrivateKey: key, Certificate: [][]byte{der}})
+	ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	return &testSigner{cert: cert, ctx: ctx}
+}
+
+// sign returns a copy of el with an enveloped signature, placed after the Issuer as the schema requires
+func (s *testSigner) sign(t *testing.T, el *etree.Element) *etree.Element {
+	signed, err := s.ctx.SignEnveloped(el)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := signed.RemoveChildAt(len(signed.Child) - 1)
+	signed.InsertChildAt(1, signature)
+	return signed
+}
+
+// newTestResponse builds a valid, unsigned, response to testRequestID, with a single assertion
+func newTestResponse() (*etree.Document, *etree.Element, *etree.Element) {
+	ts := func(t time.Time) string { return t.Format(time.RFC3339) }
+	doc := etree.NewDocument()
+	resp := doc.CreateElement("samlp:Response")
+	resp.CreateAttr("xmlns:samlp", protocolNS)
+	resp.CreateAttr("xmlns:saml", assertionNS)
+	resp.CreateAttr("ID", "_response1")
+	resp.CreateAttr("Version", "2.0")
+	resp.CreateAttr("IssueInstant", ts(testNow))
+	resp.CreateAttr("Destination", testAcsURL)
+	resp.CreateAttr("InResponseTo", testRequestID)
+	resp.CreateElement("saml:Issuer").SetText(testIdpEntityID)
+	resp.CreateElement("samlp:Status").CreateElement("samlp:StatusCode").CreateAttr("Value", statusSuccess)
+
+	a := resp.CreateElement("saml:Assertion")
+	a.CreateAttr("xmlns:saml", assertionNS)
+	a.CreateAttr("ID", "_assertion1")
+	a.CreateAttr("Version", "2.0")
+	a.CreateAttr("IssueInstant", ts(testNow))
+	a.CreateElement("saml:Issuer").SetText(testIdpEntityID)
+	subject := a.CreateElement("saml:Subject")
+	subject.CreateElement("saml:NameID").SetText("john")
+	confirmation := subject.CreateElement("saml:SubjectConfirmation")
+	confirmation.CreateAttr("Method", bearerConfirmation)
+	data := confirmation.CreateElement("saml:SubjectConfirmationData")
+	data.CreateAttr("Recipient", testAcsURL)
+	data.CreateAttr("InResponseTo", testRequestID)
+	data.CreateAttr("NotOnOrAfter", ts(testNow.Add(5*time.Minute)))
+	conditions := a.CreateElement("saml:Conditions")
+	conditions.CreateAttr("NotBefore", ts(testNow.Add(-time.Minute)))
+	conditions.CreateAttr("NotOnOrAfter", ts(testNow.Add(5*time.Minute)))
+	conditions.CreateElement("saml:AudienceRestriction").CreateElement("saml:Audience").SetText(testSpEntityID)
+	statement := a.CreateElement("saml:AuthnStatement")
+	statement.CreateAttr("AuthnInstant", ts(testNow))
+	statement.CreateAttr("SessionIndex", "session1")
+	return doc, resp, a
+}
+
+func TestValidateResponse(t *testing.T) {
+	signer := newTestSigner(t)
+	otherSigner := newTestSigner(t)
+	app := &SamlApp{
+		config: &config.SamlConfig{EntityID: testSpEntityID},
+		acsURL: testAcsURL,
+		idp:    &idpMetadata{entityID: testIdpEntityID, certs: []*x509.Certificate{signer.cert}},
+	}
+	signAssertion := func(t *testing.T, doc *etree.Document, resp, a *etree.Element) {
+		resp.AddChild(signer.sign(t, a))
+		resp.RemoveChild(a)
+	}
+	signResponse := func(t *testing.T, doc *etree.Document, resp, a *etree.Element) {
+		doc.SetRoot(signer.sign(t, resp))
+	}
+
+	tests := []struct {
+		name string
+		// Applied to the valid response, before signing it
+		modify func(resp, a *etree.Element)
+		// Signs the response and/or the assertion, then possibly alters the result
+		sign func(t *testing.T, doc *etree.Document, resp, a *etree.Element)
+		err  string
+	}{
+		{
+			name: "signed assertion",
+			sign: signAssertion,
+		},
+		{
+			name: "signed response",
+			sign: signResponse,
+		},
+		{
+			name: "unsigned",
+			sign: func(t *testing.T, doc *etree.Document, resp, a *etree.Element) {},
+			err:  "neither the response nor the assertion is signed",
+		},
+		{
+			name: "signed by another key",
+			sign: func(t *testing.T, doc *etree.Document, resp, a *etree.Element) {
+				resp.AddChild(otherSigner.sign(t, a))
+				resp.RemoveChild(a)
+			},
+			err: "assertion signature",
+		},
+		{
+			name: "modified after signing",
+			sign: func(t *testing.T, doc *etree.Document, resp, a *etree.Element) {
+				signAssertion(t, doc, resp, a)
+				doc.FindElement("//NameID").SetText("admin")
+			},
+			err: "assertion signature",
+		},
+		{
+			name: "signature wrapping",
+			// A forged assertion carries the signature of the genuine one, which is moved inside it
+			sign: func(t *testing.T, doc *etree.Document, resp, a *etree.Element) {
+				signed := signer.sign(t, a)
+				resp.RemoveChild(a)
+				forged := signed.Copy()
+				forged.FindElement("./Subject/NameID").SetText("admin")
+				forged.FindElement("./Subject").AddChild(signed)
+				resp.AddChild(forged)
+			},
+			err: "assertion signature",
+		},
+		{
+			name: "unsigned assertion added to a signed response",
+			sign: func(t *testing.T, doc *etree.Document, resp, a *etree.Element) {
+				signResponse(t, doc, resp, a)
+				forged := a.Copy()
+				forged.FindElement("./Subject/NameID").SetText("admin")
+				doc.Root().AddChild(forged)
+			},
+			err: "response signature",
+		},
+		{
+			name: "two assertions",
+			modify: func(resp, a *etree.Element) {
+				second := a.Copy()
+				second.SelectAttr("ID").Value = "_assertion2"
+				resp.AddChild(second)
+			},
+			sign: signResponse,
+			err:  "2 assertions found",
+		},
+		{
+			name:   "wrong response InResponseTo",
+			modify: func(resp, a *etree.Element) { resp.SelectAttr("InResponseTo").Value = "_other" },
+			sign:   signAssertion,
+			err:    "InResponseTo '_other' does not match",
+		},
+		{
+			name: "wrong confirmation InResponseTo",
+			modify: func(resp, a *etree.Element) {
+				a.FindElement("./Subject/SubjectConfirmation/SubjectConfirmationData").SelectAttr("InResponseTo").Value = "_other"
+			},
+			sign: signAssertion,
+			err:  "no valid bearer SubjectConfirmation",
+		},
+		{
+			name: "wrong Recipient",
+			modify: func(resp, a *etree.Element) {
+				a.FindElement("./Subject/SubjectConfirmation/SubjectConfirmationData").SelectAttr("Recipient").Value = "https://other.example.com/acs"
+			},
+			sign: signAssertion,
+			err:  "no valid bearer SubjectConfirmation",
+		},
+		{
+			name:   "wrong Destination",
+			modify: func(resp, a *etree.Element) { resp.SelectAttr("Destination").Value = "https://other.example.com/acs" },
+			sign:   signResponse,
+			err:    "destination",
+		},
+		{
+			name: "wrong audience",
+			modify: func(resp, a *etree.Element) {
+				a.FindElement("./Conditions/AudienceRestriction/Audience").SetText("https://other.example.com")
+			},
+			sign: signAssertion,
+			err:  "does not include",
+		},
+		{
+			name: "no AudienceRestriction",
+			modify: func(resp, a *etree.Element) {
+				conditions := a.FindElement("./Conditions")
+				conditions.RemoveChild(conditions.FindElement("./AudienceRestriction"))
+			},
+			sign: signAssertion,
+			err:  "no AudienceRestriction",
+		},
+		{
+			name:   "no Conditions",
+			modify: func(resp, a *etree.Element) { a.RemoveChild(a.FindElement("./Conditions")) },
+			sign:   signAssertion,
+			err:    "no AudienceRestriction",
+		},
+		{
+			name: "expired assertion",
+			modify: func(resp, a *etree.Element) {
+				a.FindElement("./Conditions").SelectAttr("NotOnOrAfter").Value = testNow.Add(-5 * time.Minute).Format(time.RFC3339)
+			},
+			sign: signAssertion,
+			err:  "assertion has expired",
+		},
+		{
+			name: "expired confirmation",
+			modify: func(resp, a *etree.Element) {
+				a.FindElement("./Subject/SubjectConfirmation/SubjectConfirmationData").SelectAttr("NotOnOrAfter").Value = testNow.Add(-5 * time.Minute).Format(time.RFC3339)
+			},
+			sign: signAssertion,
+			err:  "no valid bearer SubjectConfirmation",
+		},
+		{
+			name: "not yet valid assertion",
+			modify: func(resp, a *etree.Element) {
+				a.FindElement("./Conditions").SelectAttr("NotBefore").Value = testNow.Add(5 * time.Minute).Format(time.RFC3339)
+			},
+			sign: signAssertion,
+			err:  "assertion is not yet valid",
+		},
+		{
+			name:   "wrong assertion issuer",
+			modify: func(resp, a *etree.Element) { a.FindElement("./Issuer").SetText("https://other.example.com") },
+			sign:   signAssertion,
+			err:    "assertion issuer",
+		},
+		{
+			name:   "no AuthnStatement",
+			modify: func(resp, a *etree.Element) { a.RemoveChild(a.FindElement("./AuthnStatement")) },
+			sign:   signAssertion,
+			err:    "no AuthnStatement",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			doc, resp, a := newTestResponse()
+			if test.modify != nil {
+				test.modify(resp, a)
+			}
+			test.sign(t, doc, resp, a)
+			data, err := doc.WriteToBytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := app.validateResponse(data, testRequestID, testNow)
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if result.Subject.NameID != "john" {
+					t.Errorf("NameID is '%s', expected 'john'", result.Subject.NameID)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected an error containing '%s', got none", test.err)
+			}
+			if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing '%s', got: %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestNewLoginData(t *testing.T) {
+	_, _, a := newTestResponse()
+	statement := a.CreateElement("saml:AttributeStatement")
+	for name, values := range map[string][]string{"displayName": {"John"}, "mail": {"john@example.com"}, "memberOf": {"dev", "ops"}} {
+		attribute := statement.CreateElement("saml:Attribute")
+		attribute.CreateAttr("Name", name)
+		for _, value := range values {
+			attribute.CreateElement("saml:AttributeValue").SetText(value)
+		}
+	}
+	var decoded assertion
+	if err := unmarshalElement(a, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	attributes := config.SamlAttributesConfig{Name: "displayName", Email: "mail", Groups: "memberOf"}
+	tests := []struct {
+		name       string
+		claims     config.ClaimsConfig
+		attributes config.SamlAttributesConfig
+		trustEmail bool
+		identity   *identity.Identity
+	}{
+		{
+			name:       "default mapping",
+			claims:     config.ClaimsConfig{Username: "name", Email: "email", EmailVerified: "email_verified", Groups: "groups"},
+			attributes: attributes,
+			trustEmail: true,
+			identity:   &identity.Identity{Issuer: testIdpEntityID, Username: "John", Email: "john@example.com", EmailVerified: true, Groups: []string{"dev", "ops"}},
+		},
+		{
+			name:       "custom mapping",
+			claims:     config.ClaimsConfig{Username: "preferred_username", Email: "mail", EmailVerified: "mail_verified", Groups: "realm_access.roles"},
+			attributes: attributes,
+			identity:   &identity.Identity{Issuer: testIdpEntityID, Username: "John", Email: "john@example.com", Groups: []string{"dev", "ops"}},
+		},
+		{
+			name:       "NameID and missing attributes",
+			claims:     config.ClaimsConfig{Username: "preferred_username", Email: "mail", EmailVerified: "mail_verified", Groups: "realm_access.roles"},
+			attributes: config.SamlAttributesConfig{Email: "email", Groups: "groups"},
+			trustEmail: true,
+			identity:   &identity.Identity{Issuer: testIdpEntityID, Username: "john", Groups: []string{}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mapping := identity.NewMapping(test.claims)
+			app := &SamlApp{
+				config:  &config.SamlConfig{Attributes: test.attributes, TrustEmail: test.trustEmail},
+				mapping: mapping,
+			}
+			loginData, err := app.newLoginData(&decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, err := mapping.FromClaims(loginData.Claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(id, test.identity) {
+				t.Errorf("expected %+v, got %+v (claims: %s)", test.identity, id, loginData.Claims)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package samlapp
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"dexgate/internal/config"
+	"dexgate/internal/identity"
+	"dexgate/pkg/configwatcher"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SAML 2.0 namespaces and bindings
+const (
+	protocolNS      = "urn:oasis:names:tc:SAML:2.0:protocol"
+	assertionNS     = "urn:oasis:names:tc:SAML:2.0:assertion"
+	metadataNS      = "urn:oasis:names:tc:SAML:2.0:metadata"
+	redirectBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	postBinding     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+)
+
+// How often the IdP metadata file is checked for change
+const idpMetadataPollInterval = 30 * time.Second
+
+// ProviderName identify the SAML IdP in the session, as the provider name does for OIDC
+const ProviderName = "saml"
+
+// SamlApp is dexgate acting as a SAML 2.0 service provider (SP), with SP-initiated login only.
+type SamlApp struct {
+	config  *config.SamlConfig
+	mapping *identity.Mapping // Where the user identity is stored in the claims
+	acsURL  string
+	signer  *dsig.SigningContext // nil if no SP key is configured
+	cert    []byte               // SP certificate (DER). nil if none
+	mutex   sync.RWMutex
+	idp     *idpMetadata
+	watcher configwatcher.ConfigWatcher
+}
+
+func NewSamlApp(samlConfig *config.SamlConfig, mapping *identity.Mapping) (*SamlApp, error) {
+	app := &SamlApp{
+		config:  samlConfig,
+		mapping: mapping,
+		acsURL:  samlConfig.RootURL + "/dg_saml/acs",
+	}
+	if samlConfig.KeyFile != "" {
+		keyPair, err := tls.LoadX509KeyPair(samlConfig.CertFile, samlConfig.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load SP key pair: %v", err)
+		}
+		// XML signatures with EC keys are not handled properly by the signing library
+		key, ok := keyPair.PrivateKey.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("SP private key must be an RSA key")
+		}
+		if app.signer, err = dsig.NewSigningContext(key, keyPair.Certificate); err != nil {
+			return nil, err
+		}
+		app.signer.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+		app.cert = keyPair.Certificate[0]
+	}
+	watcher, err := configwatcher.NewPollingFileWatcher(samlConfig.IdpMetadataFile, idpMetadataPollInterval, config.Log)
+	if err != nil {
+		return nil, err
+	}
+	data, err := watcher.Get()
+	if err != nil {
+		return nil, err
+	}
+	if app.idp, err = parseIdpMetadata([]byte(data)); err != nil {
+		return nil, fmt.Errorf("unable to load IdP metadata '%s': %v", samlConfig.IdpMetadataFile, err)
+	}
+	if app.idp.wantAuthnRequestsSigned && app.signer == nil {
+		return nil, fmt.Errorf("IdP '%s' requires signed authentication requests. 'saml.keyFile' and 'saml.certFile' must be defined", app.idp.entityID)
+	}
+	if _, ok := app.idp.ssoURLs[app.binding()]; !ok {
+		return nil, fmt.Errorf("IdP '%s' does not provide a SingleSignOnService for binding '%s'", app.idp.entityID, app.binding())
+	}
+	config.Log.Infof("SAML IdP metadata '%s' loaded (entityID: %s, %d signing certificate(s))", samlConfig.IdpMetadataFile, app.idp.entityID, len(app.idp.certs))
+	err = watcher.Watch(func(data string) {
+		idp, err := parseIdpMetadata([]byte(data))
+		if err == nil {
+			if _, ok := idp.ssoURLs[app.binding()]; !ok {
+				err = fmt.Errorf("no SingleSignOnService for binding '%s'", app.binding())
+			}
+		}
+		if err != nil {
+			config.Log.Errorf("Error on reloading SAML IdP metadata '%s': %v. Keep old version", samlConfig.IdpMetadataFile, err)
+			return
+		}
+		app.mutex.Lock()
+		app.idp = idp
+		app.mutex.Unlock()
+		config.Log.Infof("SAML IdP metadata '%s' reloaded (entityID: %s, %d signing certificate(s))", samlConfig.IdpMetadataFile, idp.entityID, len(idp.certs))
+	})
+	if err != nil {
+		return nil, err
+	}
+	app.watcher = watcher
+	return app, nil
+}
+
+func (app *SamlApp) currentIdp() *idpMetadata {
+	app.mutex.RLock()
+	defer app.mutex.RUnlock()
+	return app.idp
+}
+
+func (app *SamlApp) binding() string {
+	if app.config.Binding == "post" {
+		return postBinding
+	}
+	return redirectBinding
+}
+
+// IdpEntityID return the entity ID of the IdP, used as issuer of the user claims
+func (app *SamlApp) IdpEntityID() string {
+	return app.currentIdp().entityID
+}
+
+// LoginRequest is an authentication request (AuthnRequest) to send to the IdP.
+type LoginRequest struct {
+	ID     string     // To be matched by the response 'InResponseTo'
+	URL    string     // Where to send the user
+	Fields url.Values // For the 'post' binding, the form to post to URL. nil for the 'redirect' binding
+}
+
+// NewLoginRequest build an authentication request. authParams are the OIDC authorization parameters of a step-up rule,
+// translated in SAML: 'acr_values' to RequestedAuthnContext, 'max_age' and 'prompt=login' to ForceAuthn.
+func (app *SamlApp) NewLoginRequest(authParams map[string]string) (*LoginRequest, error) {
+	idp := app.currentIdp()
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("unable to generate SAML request ID: %w", err)
+	}
+	// An ID must not start with a digit (xs:ID)
+	request := &LoginRequest{ID: "id-" + hex.EncodeToString(b), URL: idp.ssoURLs[app.binding()]}
+
+	doc := etree.NewDocument()
+	authnRequest := doc.CreateElement("samlp:AuthnRequest")
+	authnRequest.CreateAttr("xmlns:samlp", protocolNS)
+	authnRequest.CreateAttr("xmlns:saml", assertionNS)
+	authnRequest.CreateAttr("ID", request.ID)
+	authnRequest.CreateAttr("Version", "2.0")
+	authnRequest.CreateAttr("IssueInstant", time.Now().UTC().Format(time.RFC3339))
+	authnRequest.CreateAttr("Destination", request.URL)
+	authnRequest.CreateAttr("ProtocolBinding", postBinding)
+	authnRequest.CreateAttr("AssertionConsumerServiceURL", app.acsURL)
+	if authParams["max_age"] != "" || authParams["prompt"] == "login" {
+		authnRequest.CreateAttr("ForceAuthn", "true")
+	}
+	authnRequest.CreateElement("saml:Issuer").SetText(app.config.EntityID)
+	nameIDPolicy := authnRequest.CreateElement("samlp:NameIDPolicy")
+	if app.config.NameIDFormat != "" {
+		nameIDPolicy.CreateAttr("Format", app.config.NameIDFormat)
+	}
+	nameIDPolicy.CreateAttr("AllowCreate", "true")
+	if acrValues := strings.Fields(authParams["acr_values"]); len(acrValues) > 0 {
+		requestedAuthnContext := authnRequest.CreateElement("samlp:RequestedAuthnContext")
+		requestedAuthnContext.CreateAttr("Comparison", "exact")
+		for _, acr := range acrValues {
+			requestedAuthnContext.CreateElement("saml:AuthnContextClassRef").SetText(acr)
+		}
+	}
+
+	if app.config.Binding == "post" {
+		if app.signer != nil {
+			signed, err := app.signer.SignEnveloped(authnRequest)
+			if err != nil {
+				return nil, fmt.Errorf("unable to sign SAML request: %v", err)
+			}
+			// The schema requires the signature to follow the Issuer. It is appended without a parent link, so is removed by index
+			signature := signed.RemoveChildAt(len(signed.Child) - 1)
+			signed.InsertChildAt(1, signature)
+			doc.SetRoot(signed)
+		}
+		data, err := doc.WriteToBytes()
+		if err != nil {
+			return nil, err
+		}
+		request.Fields = url.Values{"SAMLRequest": {base64.StdEncoding.EncodeToString(data)}}
+		return request, nil
+	}
+
+	// Redirect binding: deflated request in the query. Signature, if any, is on the query string.
+	// See https://docs.oasis-open.org/security/saml/v2.0/saml-bindings-2.0-os.pdf, section 3.4.4.1
+	data, err := doc.WriteToBytes()
+	if err != nil {
+		return nil, err
+	}
+	var deflated bytes.Buffer
+	writer, err := flate.NewWriter(&deflated, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	query := "SAMLRequest=" + url.QueryEscape(base64.StdEncoding.EncodeToString(deflated.Bytes()))
+	if app.signer != nil {
+		query += "&SigAlg=" + url.QueryEscape(app.signer.GetSignatureMethodIdentifier())
+		signature, err := app.signer.SignString(query)
+		if err != nil {
+			return nil, fmt.Errorf("unable to sign SAML request: %v", err)
+		}
+		query += "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature))
+	}
+	if strings.Contains(request.URL, "?") {
+		request.URL += "&" + query
+	} else {
+		request.URL += "?" + query
+	}
+	return request, nil
+}
@@ -0,0 +1,196 @@
+package sessions
+
+import (
+	"dexgate/internal/config"
+	"github.com/alexedwards/scs/v2"
+	"sync"
+	"time"
+)
+
+/*
+ IndexedStore wrap a scs.Store, to maintain an index from OIDC subject and session ID (sid) to session tokens.
+ As subjects and sids are only unique per issuer, they are indexed together with the provider name.
+ This allows destroying all the sessions of a user from outside of its HTTP exchanges, as required by back-channel logout.
+ Index is built by decoding session data on each commit. So, it is independent of the underlying store.
+ Destroyed sessions are remembered until their expiry: A request in flight for such session must not bring it back on commit.
+*/
+
+type IndexedStore struct {
+	scs.Store
+	codec       scs.Codec
+	providerKey string
+	subjectKey  string
+	sidKey      string
+	mutex       sync.Mutex
+	entries     map[string]indexEntry // By session token
+	bySubject   map[string]map[string]bool
+	bySid       map[string]map[string]bool
+	destroyed   map[string]time.Time // Expiry, by session token
+}
+
+type indexEntry struct {
+	subject string
+	sid     string
+	expiry  time.Time
+}
+
+// NewIndexedStore wrap the provided store. providerKey, subjectKey and sidKey are the session keys hosting the values to index.
+func NewIndexedStore(store scs.Store, codec scs.Codec, providerKey string, subjectKey string, sidKey string, cleanupInterval time.Duration) *IndexedStore {
+	s := &IndexedStore{
+		Store:       store,
+		codec:       codec,
+		providerKey: providerKey,
+		subjectKey:  subjectKey,
+		sidKey:      sidKey,
+		entries:     make(map[string]indexEntry),
+		bySubject:   make(map[string]map[string]bool),
+		bySid:       make(map[string]map[string]bool),
+		destroyed:   make(map[string]time.Time),
+	}
+	if cleanupInterval > 0 {
+		go s.startCleanup(cleanupInterval)
+	}
+	return s
+}
+
+func (s *IndexedStore) Find(token string) ([]byte, bool, error) {
+	if s.isDestroyed(token) {
+		return nil, false, nil
+	}
+	return s.Store.Find(token)
+}
+
+func (s *IndexedStore) Commit(token string, b []byte, expiry time.Time) error {
+	if s.isDestroyed(token) {
+		return nil
+	}
+	if err := s.Store.Commit(token, b, expiry); err != nil {
+		return err
+	}
+	// Destroyed meanwhile
+	if s.isDestroyed(token) {
+		return s.Store.Delete(token)
+	}
+	_, values, err := s.codec.Decode(b)
+	if err != nil {
+		// Should not occurs, as data has just been encoded by the same codec
+		config.Log.Errorf("Unable to decode session data for indexing: %v", err)
+		return nil
+	}
+	provider, _ := values[s.providerKey].(string)
+	subject, _ := values[s.subjectKey].(string)
+	sid, _ := values[s.sidKey].(string)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.unindex(token)
+	if subject != "" || sid != "" {
+		entry := indexEntry{subject: indexKey(provider, subject), sid: indexKey(provider, sid), expiry: expiry}
+		s.entries[token] = entry
+		addToIndex(s.bySubject, entry.subject, token)
+		addToIndex(s.bySid, entry.sid, token)
+	}
+	return nil
+}
+
+func (s *IndexedStore) Delete(token string) error {
+	if err := s.Store.Delete(token); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.unindex(token)
+	return nil
+}
+
+// DestroyBySubject delete all sessions of the given subject of the given provider. Return the number of deleted sessions
+func (s *IndexedStore) DestroyBySubject(provider string, subject string) (int, error) {
+	return s.destroy(s.bySubject, indexKey(provider, subject))
+}
+
+// DestroyBySid delete all sessions bound to the given OIDC session ID of the given provider. Return the number of deleted sessions
+func (s *IndexedStore) DestroyBySid(provider string, sid string) (int, error) {
+	return s.destroy(s.bySid, indexKey(provider, sid))
+}
+
+func (s *IndexedStore) destroy(index map[string]map[string]bool, key string) (int, error) {
+	if key == "" {
+		return 0, nil
+	}
+	s.mutex.Lock()
+	tokens := make([]string, 0, len(index[key]))
+	for token := range index[key] {
+		tokens = append(tokens, token)
+		s.destroyed[token] = s.entries[token].expiry
+	}
+	s.mutex.Unlock()
+	for _, token := range tokens {
+		if err := s.Delete(token); err != nil {
+			return 0, err
+		}
+	}
+	return len(tokens), nil
+}
+
+func (s *IndexedStore) isDestroyed(token string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.destroyed[token]
+	return ok
+}
+
+// Must be called with mutex held
+func (s *IndexedStore) unindex(token string) {
+	entry, ok := s.entries[token]
+	if !ok {
+		return
+	}
+	delete(s.entries, token)
+	removeFromIndex(s.bySubject, entry.subject, token)
+	removeFromIndex(s.bySid, entry.sid, token)
+}
+
+func (s *IndexedStore) startCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		now := time.Now()
+		s.mutex.Lock()
+		for token, entry := range s.entries {
+			if now.After(entry.expiry) {
+				s.unindex(token)
+			}
+		}
+		for token, expiry := range s.destroyed {
+			if now.After(expiry) {
+				delete(s.destroyed, token)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// Empty if value is empty, to not index sessions without such value
+func indexKey(provider string, value string) string {
+	if value == "" {
+		return ""
+	}
+	return provider + "|" + value
+}
+
+func addToIndex(index map[string]map[string]bool, key string, token string) {
+	if key == "" {
+		return
+	}
+	if index[key] == nil {
+		index[key] = make(map[string]bool)
+	}
+	index[key][token] = true
+}
+
+func removeFromIndex(index map[string]map[string]bool, key string, token string) {
+	if tokens, ok := index[key]; ok {
+		delete(tokens, token)
+		if len(tokens) == 0 {
+			delete(index, key)
+		}
+	}
+}
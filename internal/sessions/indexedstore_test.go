@@ -0,0 +1,112 @@
+package sessions
+
+import (
+	"github.com/alexedwards/scs/v2"
+	"github.com/alexedwards/scs/v2/memstore"
+	"testing"
+	"time"
+)
+
+// hookStore call onCommit once the underlying store has committed, to run concurrent operations at this precise point
+type hookStore struct {
+	scs.Store
+	onCommit func(token string)
+}
+
+func (s *hookStore) Commit(token string, b []byte, expiry time.Time) error {
+	if err := s.Store.Commit(token, b, expiry); err != nil {
+		return err
+	}
+	if s.onCommit != nil {
+		s.onCommit(token)
+	}
+	return nil
+}
+
+type testSession struct {
+	token    string
+	provider string
+	subject  string
+	sid      string
+}
+
+func commit(t *testing.T, store *IndexedStore, session testSession) {
+	expiry := time.Now().Add(time.Hour)
+	b, err := scs.GobCodec{}.Encode(expiry, map[string]interface{}{"provider": session.provider, "sub": session.subject, "sid": session.sid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Commit(session.token, b, expiry); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIndexedStore(t *testing.T) {
+	sessions := []testSession{
+		{"t1", "dex", "john", "s1"},
+		{"t2", "dex", "john", "s2"},
+		{"t3", "dex", "jane", "s3"},
+		{"t4", "other", "john", "s1"},
+		{"t5", "dex", "", ""}, // Not logged in
+	}
+	tests := []struct {
+		name      string
+		destroy   func(store *IndexedStore) (int, error)
+		destroyed []string
+	}{
+		{"by subject", func(store *IndexedStore) (int, error) { return store.DestroyBySubject("dex", "john") }, []string{"t1", "t2"}},
+		{"by sid", func(store *IndexedStore) (int, error) { return store.DestroyBySid("dex", "s1") }, []string{"t1"}},
+		{"other provider", func(store *IndexedStore) (int, error) { return store.DestroyBySid("other", "s1") }, []string{"t4"}},
+		{"unknown subject", func(store *IndexedStore) (int, error) { return store.DestroyBySubject("dex", "jim") }, nil},
+		{"empty subject", func(store *IndexedStore) (int, error) { return store.DestroyBySubject("dex", "") }, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			underlying := memstore.NewWithCleanupInterval(0)
+			store := NewIndexedStore(underlying, scs.GobCodec{}, "provider", "sub", "sid", 0)
+			for _, session := range sessions {
+				commit(t, store, session)
+			}
+			n, err := test.destroy(store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(test.destroyed) {
+				t.Errorf("expected %d destroyed sessions, got %d", len(test.destroyed), n)
+			}
+			destroyed := make(map[string]bool)
+			for _, token := range test.destroyed {
+				destroyed[token] = true
+			}
+			for _, session := range sessions {
+				// A request in flight for a destroyed session must not bring it back on commit
+				commit(t, store, session)
+				_, found, _ := store.Find(session.token)
+				_, stored, _ := underlying.Find(session.token)
+				if found == destroyed[session.token] || stored == destroyed[session.token] {
+					t.Errorf("session %s: expected destroyed %v, got found %v and stored %v", session.token, destroyed[session.token], found, stored)
+				}
+			}
+		})
+	}
+}
+
+// A session destroyed while being committed must not survive the commit
+func TestIndexedStoreDestroyDuringCommit(t *testing.T) {
+	underlying := &hookStore{Store: memstore.NewWithCleanupInterval(0)}
+	store := NewIndexedStore(underlying, scs.GobCodec{}, "provider", "sub", "sid", 0)
+	commit(t, store, testSession{"t1", "dex", "john", "s1"})
+	underlying.onCommit = func(token string) {
+		underlying.onCommit = nil
+		if n, err := store.DestroyBySid("dex", "s1"); n != 1 || err != nil {
+			t.Errorf("expected a destroyed session, got %d %v", n, err)
+		}
+	}
+	commit(t, store, testSession{"t1", "dex", "john", "s1"})
+	if _, found, _ := underlying.Find("t1"); found {
+		t.Errorf("the destroyed session has been committed")
+	}
+	if n, _ := store.DestroyBySubject("dex", "john"); n != 0 {
+		t.Errorf("the destroyed session is still indexed")
+	}
+}
@@ -0,0 +1,143 @@
+package stepup
+
+import (
+	"dexgate/internal/config"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rule require a stronger authentication for a path prefix.
+type Rule struct {
+	Path       string
+	acr        []string
+	amr        []string
+	maxAuthAge time.Duration
+}
+
+// Rules is the set of step-up rules. Longest matching path wins.
+type Rules []*Rule
+
+func NewRules(configs []config.StepUpConfig) Rules {
+	rules := make(Rules, 0, len(configs))
+	for _, c := range configs {
+		rules = append(rules, &Rule{
+			Path:       c.Path,
+			acr:        c.Acr,
+			amr:        c.Amr,
+			maxAuthAge: c.MaxAuthAgeDuration,
+		})
+	}
+	return rules
+}
+
+// Match return the rule applying to the given URL path. nil if none.
+// A rule applies to its path and all sub-paths ('/admin' match '/admin' and '/admin/users', but not '/administrator')
+func (rules Rules) Match(path string) *Rule {
+	var match *Rule
+	for _, rule := range rules {
+		applies := path == rule.Path || strings.HasPrefix(path, strings.TrimSuffix(rule.Path, "/")+"/")
+		if applies && (match == nil || len(rule.Path) > len(match.Path)) {
+			match = rule
+		}
+	}
+	return match
+}
+
+// Get return the rule defined for this exact path. nil if none (i.e. the configuration has changed)
+func (rules Rules) Get(path string) *Rule {
+	for _, rule := range rules {
+		if rule.Path == path {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Authentication is the authentication context of a session or a token, as provided by the OIDC server.
+type Authentication struct {
+	Acr      string    // acr claim. Empty if not provided
+	Amr      []string  // amr claim
+	AuthTime time.Time // auth_time claim. Zero if not provided
+}
+
+// AuthenticationFromClaims extract the authentication context from a JSON encoded claims set
+func AuthenticationFromClaims(claims string) (Authentication, error) {
+	var c struct {
+		Acr      string   `json:"acr"`
+		Amr      []string `json:"amr"`
+		AuthTime float64  `json:"auth_time"`
+	}
+	if err := json.Unmarshal([]byte(claims), &c); err != nil {
+		return Authentication{}, err
+	}
+	auth := Authentication{Acr: c.Acr, Amr: c.Amr}
+	if c.AuthTime != 0 {
+		auth.AuthTime = time.Unix(int64(c.AuthTime), 0)
+	}
+	return auth, nil
+}
+
+// Check return nil if the authentication fulfill the rule. Otherwise, an error telling why.
+func (rule *Rule) Check(auth Authentication) error {
+	if len(rule.acr) > 0 && !contains(rule.acr, auth.Acr) {
+		return fmt.Errorf("acr '%s' is not one of %v", auth.Acr, rule.acr)
+	}
+	if len(rule.amr) > 0 {
+		found := false
+		for _, amr := range auth.Amr {
+			found = found || contains(rule.amr, amr)
+		}
+		if !found {
+			return fmt.Errorf("amr %v does not contain one of %v", auth.Amr, rule.amr)
+		}
+	}
+	if rule.maxAuthAge > 0 {
+		if auth.AuthTime.IsZero() {
+			return fmt.Errorf("authentication time is unknown")
+		}
+		if age := time.Since(auth.AuthTime); age > rule.maxAuthAge {
+			return fmt.Errorf("authentication is %s old, more than %s", age.Truncate(time.Second), rule.maxAuthAge)
+		}
+	}
+	return nil
+}
+
+// AuthParams return the parameters to add to the authorization request, for the OIDC server to perform the required authentication.
+// There is no standard parameter for 'amr'. A new authentication is then forced with 'prompt=login'
+func (rule *Rule) AuthParams() map[string]string {
+	params := make(map[string]string)
+	if len(rule.acr) > 0 {
+		params["acr_values"] = strings.Join(rule.acr, " ")
+	}
+	if rule.maxAuthAge > 0 {
+		params["max_age"] = strconv.FormatInt(int64(rule.maxAuthAge.Seconds()), 10)
+	}
+	if len(rule.amr) > 0 {
+		params["prompt"] = "login"
+	}
+	return params
+}
+
+// Challenge return the parameters of a 'WWW-Authenticate' error response for bearer tokens, as defined in RFC 9470
+func (rule *Rule) Challenge() string {
+	challenge := `error="insufficient_user_authentication", error_description="A different authentication level is required"`
+	if len(rule.acr) > 0 {
+		challenge += fmt.Sprintf(`, acr_values=%q`, strings.Join(rule.acr, " "))
+	}
+	if rule.maxAuthAge > 0 {
+		challenge += fmt.Sprintf(`, max_age="%d"`, int64(rule.maxAuthAge.Seconds()))
+	}
+	return challenge
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package templates
+
+import (
+	"html/template"
+	"net/http"
+)
+
+var errorTmpl = template.Must(template.New("error.html").Parse(`<html>
+  <head>
+    <style>
+/* make pre wrap */
+pre {
+ white-space: pre-wrap;       /* css-3 */
+ white-space: -moz-pre-wrap;  /* Mozilla, since 1999 */
+ white-space: -pre-wrap;      /* Opera 4-6 */
+ white-space: -o-pre-wrap;    /* Opera 7 */
+ word-wrap: break-word;       /* Internet Explorer 5.5+ */
+}
+    </style>
+  </head>
+  <body>
+	<h2>{{ .Title }}</h2>
+	<p><pre>{{ .Message }}</pre></p>
+	<input type="button" onclick="location.href='{{ .LandingURL }}';" value="RETRY">
+  </body>
+</html>
+`))
+
+type errorTmplData struct {
+	Title      string
+	Message    string
+	LandingURL string
+}
+
+func RenderError(w http.ResponseWriter, status int, title string, message string, landingURL string) {
+	if landingURL == "" {
+		landingURL = "/"
+	}
+	w.WriteHeader(status)
+	renderTemplate(w, errorTmpl, errorTmplData{
+		Title:      title,
+		Message:    message,
+		LandingURL: landingURL,
+	})
+}
@@ -0,0 +1,42 @@
+package templates
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+)
+
+// Post a form to the given URL, or again to the current URL.
+// Submitted from our own page, a re-posted request is no more cross-site, so the session cookie is sent, even with SameSite Lax or Strict.
+var formPostTmpl = template.Must(template.New("formpost.html").Parse(`<html>
+  <head>
+    <meta name="referrer" content="no-referrer">
+  </head>
+  <body onload="document.forms[0].submit()">
+	<form method="post"{{ if .Action }} action="{{ .Action }}"{{ end }}>
+	{{ range $name, $values := .Fields }}{{ range $values }}
+	  <input type="hidden" name="{{ $name }}" value="{{ . }}">
+	{{ end }}{{ end }}
+	  <noscript>
+		<p>Javascript is disabled. Click on the button to complete the login.</p>
+		<input type="submit" value="CONTINUE">
+	  </noscript>
+	</form>
+  </body>
+</html>
+`))
+
+type formPostTmplData struct {
+	Action string
+	Fields url.Values
+}
+
+// RenderFormPost display a page posting the given fields to action. An empty action means the current URL
+func RenderFormPost(w http.ResponseWriter, action string, fields url.Values) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	renderTemplate(w, formPostTmpl, formPostTmplData{
+		Action: action,
+		Fields: fields,
+	})
+}
@@ -0,0 +1,27 @@
+package templates
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// Intended to be loaded in an hidden iframe by the OIDC server. So, kept minimal
+var frontChannelLogoutTmpl = template.Must(template.New("frontchannel_logout.html").Parse(`<html>
+  <body>
+	<p>{{ if .LoggedOut }}Logged out{{ else }}No matching session{{ end }}</p>
+  </body>
+</html>
+`))
+
+type frontChannelLogoutTmplData struct {
+	LoggedOut bool
+}
+
+func RenderFrontChannelLogout(w http.ResponseWriter, loggedOut bool) {
+	// See https://openid.net/specs/openid-connect-frontchannel-1_0.html#RPLogout
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("Pragma", "no-cache")
+	renderTemplate(w, frontChannelLogoutTmpl, frontChannelLogoutTmplData{
+		LoggedOut: loggedOut,
+	})
+}
@@ -0,0 +1,59 @@
+package templates
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+)
+
+var providersTmpl = template.Must(template.New("providers.html").Parse(`<html>
+  <head>
+    <style>
+ul {
+ list-style-type: none;
+ padding: 0;
+}
+li {
+ margin: 8px 0;
+}
+    </style>
+  </head>
+  <body>
+	<h2>Login</h2>
+	<p>Please choose how to authenticate:</p>
+	<ul>
+	{{ range .Providers }}
+		<li><input type="button" onclick="location.href='{{ .LoginURL }}';" value="{{ .DisplayName }}"></li>
+	{{ end }}
+	</ul>
+  </body>
+</html>
+`))
+
+// Provider is an entry of the login chooser page
+type Provider struct {
+	Name        string
+	DisplayName string
+}
+
+type providerTmplData struct {
+	DisplayName string
+	LoginURL    string
+}
+
+type providersTmplData struct {
+	Providers []providerTmplData
+}
+
+// RenderProviders display the login chooser page. Each entry link to loginPath?provider=<name>
+func RenderProviders(w http.ResponseWriter, loginPath string, providers []Provider) {
+	data := providersTmplData{}
+	for _, provider := range providers {
+		data.Providers = append(data.Providers, providerTmplData{
+			DisplayName: provider.DisplayName,
+			LoginURL:    loginPath + "?provider=" + url.QueryEscape(provider.Name),
+		})
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	renderTemplate(w, providersTmpl, data)
+}
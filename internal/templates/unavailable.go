@@ -0,0 +1,39 @@
+package templates
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+)
+
+// Reloaded periodically, so the user get in as soon as the OIDC server is back
+var unavailableTmpl = template.Must(template.New("unavailable.html").Parse(`<html>
+  <head>
+    <meta http-equiv="refresh" content="{{ .RetryAfter }};url={{ .LandingURL }}">
+  </head>
+  <body>
+	<h2>Login temporarily unavailable</h2>
+	<p>The authentication server can't be reached for now. This page will be reloaded automatically.</p>
+	<input type="button" onclick="location.href='{{ .LandingURL }}';" value="RETRY">
+  </body>
+</html>
+`))
+
+type unavailableTmplData struct {
+	LandingURL string
+	RetryAfter int
+}
+
+// RenderUnavailable display a 503 page, inviting the user to retry after retryAfter seconds
+func RenderUnavailable(w http.ResponseWriter, landingURL string, retryAfter int) {
+	if landingURL == "" {
+		landingURL = "/"
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	renderTemplate(w, unavailableTmpl, unavailableTmplData{
+		LandingURL: landingURL,
+		RetryAfter: retryAfter,
+	})
+}
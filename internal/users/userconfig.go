@@ -1,6 +1,15 @@
 package users
 
 type UserConfig struct {
+	AllowedUsers  []string       `yaml:"allowedUsers"`
+	AllowedGroups []string       `yaml:"allowedGroups"`
+	AllowedEmails []string       `yaml:"allowedEmails"`
+	Issuers       []IssuerConfig `yaml:"issuers"`   // Additional rules, applying only to users authenticated by a given issuer
+	AnyIssuer     bool           `yaml:"anyIssuer"` // With several providers, the above global rules must be explicitly enabled for all issuers
+}
+
+type IssuerConfig struct {
+	Issuer        string   `yaml:"issuer"` // Must match the 'iss' claim. i.e. the issuerURL of the provider
 	AllowedUsers  []string `yaml:"allowedUsers"`
 	AllowedGroups []string `yaml:"allowedGroups"`
 	AllowedEmails []string `yaml:"allowedEmails"`
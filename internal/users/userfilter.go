@@ -2,6 +2,7 @@ package users
 
 import (
 	"dexgate/internal/config"
+	"dexgate/internal/identity"
 	"dexgate/pkg/configwatcher"
 	"fmt"
 	"gopkg.in/yaml.v2"
@@ -44,7 +45,9 @@ func NewUserFilter() (UserFilter, error) {
 	if err != nil {
 		return nil, err
 	}
-	validator, err := newUserValidator(data)
+	mapping := identity.NewMapping(config.Conf.Claims)
+	multiIssuer := len(config.Conf.OidcConfigs) > 1
+	validator, err := newUserValidator(data, mapping, multiIssuer)
 	if err != nil {
 		return nil, err
 	}
@@ -55,7 +58,7 @@ func NewUserFilter() (UserFilter, error) {
 		watcher:   userWatcher,
 	}
 	usersCallback := func(data string) {
-		v, err := newUserValidator(data)
+		v, err := newUserValidator(data, mapping, multiIssuer)
 		if err != nil {
 			config.Log.Errorf("watcher on '%s': Error on reloading user configuration: '%v'. Keep old version", userWatcher.GetName(), err)
 		} else {
@@ -73,74 +76,108 @@ func NewUserFilter() (UserFilter, error) {
 }
 
 type userValidator struct {
-	config *UserConfig
+	config   *UserConfig
+	mapping  *identity.Mapping
+	global   *ruleSet
+	byIssuer map[string]*ruleSet
+}
+
+type ruleSet struct {
 	users  map[string]bool
 	groups map[string]bool
 	emails map[string]bool
 }
 
-func newUserValidator(json string) (*userValidator, error) {
+// newUserValidator parse the users yaml. With multiIssuer (Several providers), global rules would grant access to users of any
+// provider. So, they are accepted only if 'anyIssuer' is set.
+func newUserValidator(json string, mapping *identity.Mapping, multiIssuer bool) (*userValidator, error) {
 	uc := &UserConfig{}
 	if err := yaml.UnmarshalStrict([]byte(json), uc); err != nil {
 		return nil, fmt.Errorf("Error in parsing users yaml file: '%v'", err)
 	}
+	if multiIssuer && !uc.AnyIssuer && len(uc.AllowedUsers)+len(uc.AllowedGroups)+len(uc.AllowedEmails) > 0 {
+		return nil, fmt.Errorf("Error in users yaml file: with several providers, global rules apply to users of all of them. Move them to 'issuers' entries, or set 'anyIssuer: true'")
+	}
 	validator := &userValidator{
-		config: uc,
+		config:   uc,
+		mapping:  mapping,
+		global:   newRuleSet(uc.AllowedUsers, uc.AllowedGroups, uc.AllowedEmails),
+		byIssuer: make(map[string]*ruleSet),
+	}
+	for _, ic := range uc.Issuers {
+		if ic.Issuer == "" {
+			return nil, fmt.Errorf("Error in users yaml file: missing 'issuer' in 'issuers' entry")
+		}
+		if _, ok := validator.byIssuer[ic.Issuer]; ok {
+			return nil, fmt.Errorf("Error in users yaml file: issuer '%s' is defined more than once", ic.Issuer)
+		}
+		validator.byIssuer[ic.Issuer] = newRuleSet(ic.AllowedUsers, ic.AllowedGroups, ic.AllowedEmails)
+	}
+	return validator, nil
+}
+
+// Transform lists in sets
+func newRuleSet(users []string, groups []string, emails []string) *ruleSet {
+	rs := &ruleSet{
 		users:  make(map[string]bool),
 		groups: make(map[string]bool),
 		emails: make(map[string]bool),
 	}
-	// Transform lists in sets
-	for _, user := range uc.AllowedUsers {
-		validator.users[user] = true
+	for _, user := range users {
+		rs.users[user] = true
 	}
-	for _, group := range uc.AllowedGroups {
-		validator.groups[group] = true
+	for _, group := range groups {
+		rs.groups[group] = true
 	}
-	for _, email := range uc.AllowedEmails {
-		validator.emails[email] = true
+	for _, email := range emails {
+		rs.emails[email] = true
 	}
-	return validator, nil
-}
-
-type claim struct {
-	Name          string   `yaml:"name"`
-	Email         string   `yaml:"email"`
-	EmailVerified bool     `yaml:"email_verified"`
-	Groups        []string `yaml:"groups"`
+	return rs
 }
 
 func (this *userValidator) validateUser(claimJson string) (bool, error) {
-	var claim claim
-	err := yaml.Unmarshal([]byte(claimJson), &claim)
+	claim, err := this.mapping.FromClaims(claimJson)
 	if err != nil {
 		return false, err
 	}
-	if claim.Name != "" {
-		if _, ok := this.users[claim.Name]; ok {
-			config.Log.Infof("User '%s' is allowed to access", claim.Name)
+	if this.global.allow(claim, "") {
+		return true, nil
+	}
+	if rs, ok := this.byIssuer[claim.Issuer]; ok && claim.Issuer != "" {
+		if rs.allow(claim, fmt.Sprintf(" (issuer '%s')", claim.Issuer)) {
 			return true, nil
 		}
 	}
+	claim2, _ := yaml.Marshal(claim)
+	config.Log.Infof("User '%s' is NOT allowed to access this service. Claim: {\n%s}", claim.Username, claim2)
+	return false, nil
+}
+
+// allow check the claim against this rule set. scope is appended to the log messages
+func (this *ruleSet) allow(claim *identity.Identity, scope string) bool {
+	if claim.Username != "" {
+		if _, ok := this.users[claim.Username]; ok {
+			config.Log.Infof("User '%s' is allowed to access%s", claim.Username, scope)
+			return true
+		}
+	}
 	if claim.Groups != nil {
 		for _, group := range claim.Groups {
 			if _, ok := this.groups[group]; ok {
-				config.Log.Infof("user '%s' as belonging to group '%s' is allowed to access", claim.Name, group)
-				return true, nil
+				config.Log.Infof("user '%s' as belonging to group '%s' is allowed to access%s", claim.Username, group, scope)
+				return true
 			}
 		}
 	}
 	if claim.Email != "" {
 		if _, ok := this.emails[claim.Email]; ok {
 			if claim.EmailVerified {
-				config.Log.Infof("User '%s' with confirmed email '%s' is allowed to access", claim.Name, claim.Email)
-				return true, nil
+				config.Log.Infof("User '%s' with confirmed email '%s' is allowed to access%s", claim.Username, claim.Email, scope)
+				return true
 			} else {
-				config.Log.Infof("Email '%s' (User '%s') is not confirmed, so not taken in account", claim.Email, claim.Name)
+				config.Log.Infof("Email '%s' (User '%s') is not confirmed, so not taken in account", claim.Email, claim.Username)
 			}
 		}
 	}
-	claim2, _ := yaml.Marshal(&claim)
-	config.Log.Infof("User '%s' is NOT allowed to access this service. Claim: {\n%s}", claim.Name, claim2)
-	return false, nil
+	return false
 }
@@ -1,22 +1,41 @@
 package main
 
 import (
+	"dexgate/internal/bearer"
 	"dexgate/internal/config"
 	"dexgate/internal/director"
+	"dexgate/internal/identity"
 	"dexgate/internal/oidcapp"
+	"dexgate/internal/ratelimit"
+	"dexgate/internal/samlapp"
+	"dexgate/internal/sessions"
+	"dexgate/internal/stepup"
 	"dexgate/internal/templates"
 	"dexgate/internal/users"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/alexedwards/scs/v2"
 	"github.com/sirupsen/logrus"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"os"
 	"strings"
+	"time"
 )
 
 var log *logrus.Entry
 
+var stepUpRules stepup.Rules
+
+var identityMapping *identity.Mapping
+
+// nil unless dexgate is a SAML service provider
+var samlApp *samlapp.SamlApp
+
 //func dumpHeader(r *http.Request) {
 //	for name, values := range r.Header {
 //		for _, value := range values {
@@ -26,50 +45,141 @@ var log *logrus.Entry
 //}
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "dev-issuer" {
+		runDevIssuer(os.Args[2:])
+		return
+	}
 	config.Setup()
 	log = config.Log
 	log.Infof("Dexgate %s listening at '%s' to forward to '%s' (Logleve:%s)", config.Version, config.Conf.BindAddr, config.Conf.TargetURL, config.Conf.LogLevel)
 	log.Infof("Session will expire after %s of inactivity and will not be longer than %s", config.IdleTimeout.String(), config.SessionLifetime.String())
-	log.Infof("Request scopes: %s", strings.Join(config.Conf.OidcConfig.Scopes, ", "))
+	handler, userFilter := newHandler()
+	defer userFilter.Close()
+	log.Fatal(http.ListenAndServe(config.Conf.BindAddr, handler))
+}
+
+// newHandler build the dexgate handler from the configuration. The returned user filter must be closed on exit.
+func newHandler() (http.Handler, users.UserFilter) {
+	// Session values are gob encoded. Non-basic types must be registered
+	gob.Register(time.Time{})
 	sessionManager := scs.New()
 	sessionManager.Cookie.Name = "dg_session"
 	sessionManager.IdleTimeout = config.IdleTimeout
 	sessionManager.Lifetime = config.SessionLifetime
+	sessionManager.Cookie.SameSite = config.CookieSameSite
+	sessionManager.Cookie.Secure = config.Conf.SessionConfig.CookieSecure
+	sessionStore := sessions.NewIndexedStore(sessionManager.Store, sessionManager.Codec, providerKey, subjectKey, sidKey, time.Minute)
+	sessionManager.Store = sessionStore
 
 	reverseProxy := &httputil.ReverseProxy{Director: director.NewDirector(config.TargetURL)}
 
-	oidcApp, err := oidcapp.NewOidcApp(&config.Conf.OidcConfig)
+	providers, err := oidcapp.NewProviders(config.Conf.OidcConfigs)
 	if err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "ERROR: Unable to instanciate OIDC subsystem:%v'\n", err)
 		os.Exit(2)
 	}
+	identityMapping = identity.NewMapping(config.Conf.Claims)
+	if config.Conf.Saml != nil {
+		samlApp, err = samlapp.NewSamlApp(config.Conf.Saml, identityMapping)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "ERROR: Unable to instanciate SAML subsystem:%v'\n", err)
+			os.Exit(2)
+		}
+	}
 	userFilter, err := users.NewUserFilter()
 	if err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "ERROR: Unable to load '%s': %v\n", config.Conf.UsersConfigFile, err)
 		os.Exit(2)
 	}
-	defer userFilter.Close()
+	var bearerValidator bearer.Validator
+	if config.Conf.Bearer.Enabled {
+		for _, oidcApp := range providers.List() {
+			log.Infof("Bearer token authentication enabled on provider '%s' (Allowed audiences: %s)", oidcApp.Name(), strings.Join(oidcApp.BearerAudiences(), ", "))
+		}
+		validators := []bearer.Validator{bearer.NewJWTValidator(providers)}
+		if config.Conf.Bearer.Introspection.Enabled {
+			oidcApp := providers.Get(config.Conf.Bearer.Introspection.Provider)
+			log.Infof("Opaque bearer tokens will be validated by introspection on provider '%s' (Cache TTL: %s)", oidcApp.Name(), config.IntrospectionCacheTTL.String())
+			validators = append(validators, bearer.NewIntrospectionValidator(providers, oidcApp, identityMapping, config.Conf.Bearer.Introspection.GroupsAttribute, config.IntrospectionCacheTTL, config.Conf.Bearer.Introspection.CacheSize))
+		}
+		bearerValidator = bearer.NewChainValidator(validators...)
+	}
+
+	stepUpRules = stepup.NewRules(config.Conf.StepUp)
+	for _, rule := range stepUpRules {
+		log.Infof("Step-up authentication required on %s", rule.Path)
+	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/dg_logout", lougoutHandler(sessionManager))
+	if config.Conf.Device.Enabled {
+		log.Infof("Device authorization grant enabled on /dg_device")
+		limiter := ratelimit.NewLimiter(config.Conf.Device.RateLimit, time.Minute, deviceRateLimitedClients)
+		mux.Handle("/dg_device", deviceHandler(providers, limiter))
+		mux.Handle("/dg_device/token", deviceTokenHandler(sessionManager, providers, userFilter))
+	}
+	if len(oidcapp.PublicJWKS(providers).Keys) > 0 {
+		// For the OIDC server to validate our client assertions (private_key_jwt)
+		mux.Handle("/dg_jwks", jwksHandler(providers))
+	}
+	if samlApp != nil {
+		log.Infof("SAML service provider '%s' enabled. Metadata on /dg_saml/metadata", config.Conf.Saml.EntityID)
+		mux.Handle("/dg_saml/metadata", samlMetadataHandler())
+		mux.Handle("/dg_saml/acs", samlACSHandler(sessionManager, userFilter))
+	}
+	mux.Handle("/dg_ready", readyHandler(providers))
+	mux.Handle("/dg_metrics", metricsHandler(providers))
+	mux.Handle("/dg_login", loginHandler(sessionManager, providers))
+	mux.Handle("/dg_logout", lougoutHandler(sessionManager, providers))
+	mux.Handle("/dg_logged_out", loggedOutHandler())
 	mux.Handle("/dg_info", infoHandler(sessionManager))
 	mux.Handle("/dg_unallowed", unallowedHandler(sessionManager))
-	mux.Handle("/dg_callback", callbackHandler(sessionManager, oidcApp, userFilter))
+	mux.Handle("/dg_callback", callbackHandler(sessionManager, providers, userFilter))
+	mux.Handle("/dg_backchannel_logout", backChannelLogoutHandler(sessionStore, providers))
+	mux.Handle("/dg_frontchannel_logout", frontChannelLogoutHandler(sessionManager, providers))
 	for _, path := range config.Conf.Passthroughs {
 		log.Infof("Will set passthrough for %s", path)
 		mux.Handle(path, passthroughHandler(reverseProxy))
 	}
-	mux.Handle("/", mainHandler(sessionManager, reverseProxy, oidcApp))
-	log.Fatal(http.ListenAndServe(config.Conf.BindAddr, sessionManager.LoadAndSave(mux)))
+	mux.Handle("/", mainHandler(sessionManager, reverseProxy, providers, userFilter, bearerValidator))
+	return sessionManager.LoadAndSave(mux), userFilter
 }
 
+// Delay, in seconds, after which the browser retry the login if the OIDC server is not available
+const unavailableRetryAfter = 5
+
+// Maximum number of client addresses tracked by the /dg_device rate limiter. Beyond, new clients are refused
+const deviceRateLimitedClients = 10000
+
+// Marker added to a form_post callback re-posted by dexgate, to post it only once
+const formPostRelayField = "dg_relay"
+
 // Key for session object
 const (
-	landingURLKey  = "landingURL"
-	accessTokenKey = "accessToken"
-	claimKey       = "claim"
+	landingURLKey        = "landingURL"
+	accessTokenKey       = "accessToken"
+	accessTokenExpiryKey = "accessTokenExpiry"
+	idTokenKey           = "idToken"
+	refreshTokenKey      = "refreshToken"
+	idTokenExpiryKey     = "idTokenExpiry"
+	authTimeKey          = "authTime"
+	authTimeGuessedKey   = "authTimeGuessed" // No auth_time claim. authTime is the login time
+	acrKey               = "acr"
+	amrKey               = "amr" // Space separated
+	subjectKey           = "subject"
+	sidKey               = "sid"
+	claimKey             = "claim"
+	loginStateKey        = "loginState"
+	loginNonceKey        = "loginNonce"
+	loginPKCEKey         = "loginPKCE"
+	loginTimeKey         = "loginTime"
+	loginProviderKey     = "loginProvider"
+	loginStepUpKey       = "loginStepUp"
+	providerKey          = "provider"
 )
 
+// Session keys set from a login result. All are cleared on a new login, as it may be for another user
+var identityKeys = []string{accessTokenKey, accessTokenExpiryKey, idTokenKey, refreshTokenKey, idTokenExpiryKey, authTimeKey, authTimeGuessedKey, acrKey, amrKey, subjectKey, sidKey, claimKey}
+
 func passthroughHandler(reverseProxy *httputil.ReverseProxy) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Debugf("%s %s => Forward to target (passthrough)", r.Method, r.URL)
@@ -79,72 +189,819 @@ func passthroughHandler(reverseProxy *httputil.ReverseProxy) http.Handler {
 
 /*
  We store the token and the claim in the session, as markers for logged user.
- But, we don't handle token expiration nor renewal. We rely on the session lifecycle instead
+ The access token expiration is tracked. Once expired, the token is renewed using the refresh token, if any.
+ Otherwise, we rely on the session lifecycle.
 */
 
-func mainHandler(sessionManager *scs.SessionManager, reverseProxy *httputil.ReverseProxy, oidcApp *oidcapp.OidcApp) http.Handler {
+func mainHandler(sessionManager *scs.SessionManager, reverseProxy *httputil.ReverseProxy, providers *oidcapp.Providers, userFilter users.UserFilter, bearerValidator bearer.Validator) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bearerValidator != nil {
+			if bearerToken, ok := bearer.GetToken(r); ok {
+				serveBearer(w, r, bearerToken, reverseProxy, bearerValidator, userFilter)
+				return
+			}
+		}
+		// A SAML session has no token. It relies on the session lifecycle only
+		samlSession := samlApp != nil && sessionManager.GetString(r.Context(), providerKey) == samlapp.ProviderName
 		token := sessionManager.GetString(r.Context(), accessTokenKey)
-		if token == "" {
+		if token == "" && !samlSession {
 			// Fresh session. Must enter login process
-			lurl, err := oidcApp.NewLoginURL()
-			if err != nil {
-				config.Log.Errorf(err.Error())
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-			} else {
-				log.Debugf("%s %s => Not logged. Will redirect to %s", r.Method, r.URL, lurl)
-				sessionManager.Put(r.Context(), landingURLKey, r.URL.String())
-				http.Redirect(w, r, lurl, http.StatusSeeOther)
+			beginLogin(w, r, sessionManager, providers)
+			return
+		}
+		// Checked before any token renewal, which can't extend the session validity
+		if deadline := sessionDeadline(r, sessionManager); !deadline.IsZero() && time.Now().After(deadline) {
+			log.Infof("%s %s => Session has reached its maximum validity (%s). Will login again", r.Method, r.URL, deadline.String())
+			_ = sessionManager.Destroy(r.Context())
+			beginLogin(w, r, sessionManager, providers)
+			return
+		}
+		var oidcApp *oidcapp.OidcApp
+		if !samlSession {
+			oidcApp = providers.Get(sessionManager.GetString(r.Context(), providerKey))
+			if oidcApp == nil {
+				log.Infof("%s %s => Session provider is no more configured. Will login again", r.Method, r.URL)
+				_ = sessionManager.Destroy(r.Context())
+				beginLogin(w, r, sessionManager, providers)
+				return
+			}
+			expiry := sessionManager.GetTime(r.Context(), accessTokenExpiryKey)
+			if !expiry.IsZero() && time.Now().After(expiry) {
+				if !renewTokens(w, r, sessionManager, oidcApp, userFilter) {
+					return
+				}
+			}
+		}
+		if rule := stepUpRules.Match(r.URL.Path); rule != nil {
+			if err := rule.Check(sessionAuthentication(r, sessionManager)); err != nil {
+				log.Infof("%s %s => Step-up authentication required (%v). Will login again", r.Method, r.URL, err)
+				if samlSession {
+					startSamlLogin(w, r, sessionManager, r.URL.String())
+				} else {
+					startLogin(w, r, sessionManager, oidcApp, r.URL.String())
+				}
+				return
+			}
+		}
+		log.Debugf("%s %s => Forward to target (Authenticated)", r.Method, r.URL)
+		reverseProxy.ServeHTTP(w, withIdentity(r, sessionManager.GetString(r.Context(), claimKey)))
+	})
+}
+
+// serveBearer handle a request from an API or CLI client. No session is involved.
+// Errors are reported as defined in RFC 6750, section 3, instead of redirecting to login.
+func serveBearer(w http.ResponseWriter, r *http.Request, bearerToken string, reverseProxy *httputil.ReverseProxy, bearerValidator bearer.Validator, userFilter users.UserFilter) {
+	claims, err := bearerValidator.Validate(r.Context(), bearerToken)
+	if errors.Is(err, oidcapp.ErrNotReady) {
+		// The token may be valid. The client must not discard it
+		log.Warnf("%s %s => Bearer token, but %v", r.Method, r.URL, err)
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", unavailableRetryAfter))
+		http.Error(w, "Authentication temporarily unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Infof("%s %s => Invalid bearer token: %v", r.Method, r.URL, err)
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="dexgate", error="invalid_token", error_description=%q`, "The access token is invalid"))
+		http.Error(w, "Invalid bearer token", http.StatusUnauthorized)
+		return
+	}
+	logged, err := userFilter.ValidateUser(claims)
+	if err != nil {
+		log.Errorf("Unable to decode claim '%s': %v", claims, err)
+		http.Error(w, fmt.Sprintf("Unable to decode claim '%s'", claims), http.StatusInternalServerError)
+		return
+	}
+	if !logged {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="dexgate", error="insufficient_scope", error_description=%q`, "User is not allowed to access this resource"))
+		http.Error(w, "Not allowed", http.StatusForbidden)
+		return
+	}
+	if rule := stepUpRules.Match(r.URL.Path); rule != nil {
+		auth, err := stepup.AuthenticationFromClaims(claims)
+		if err == nil {
+			err = rule.Check(auth)
+		}
+		if err != nil {
+			log.Infof("%s %s => Bearer token does not fulfill step-up authentication (%v)", r.Method, r.URL, err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dexgate", `+rule.Challenge())
+			http.Error(w, "Step-up authentication required", http.StatusUnauthorized)
+			return
+		}
+	}
+	log.Debugf("%s %s => Forward to target (Bearer token)", r.Method, r.URL)
+	reverseProxy.ServeHTTP(w, withIdentity(r, claims))
+}
+
+// sessionDeadline return the time after which the session is no more valid, as capped by ID token expiration and/or maxAuthAge.
+// Zero if there is no such cap.
+func sessionDeadline(r *http.Request, sessionManager *scs.SessionManager) time.Time {
+	var deadline time.Time
+	if config.Conf.SessionConfig.CapToIDToken {
+		deadline = sessionManager.GetTime(r.Context(), idTokenExpiryKey)
+	}
+	if config.MaxAuthAge > 0 {
+		if authTime := sessionManager.GetTime(r.Context(), authTimeKey); !authTime.IsZero() {
+			maxAuthTime := authTime.Add(config.MaxAuthAge)
+			if deadline.IsZero() || maxAuthTime.Before(deadline) {
+				deadline = maxAuthTime
 			}
+		}
+	}
+	return deadline
+}
+
+// withIdentity attach the user identity to the request, for the director to provide it to the target application (identityHeaders)
+func withIdentity(r *http.Request, claims string) *http.Request {
+	if !director.IdentityHeadersEnabled() || claims == "" {
+		return r
+	}
+	id, err := identityMapping.FromClaims(claims)
+	if err != nil {
+		log.Errorf("Unable to extract identity from claim '%s': %v", claims, err)
+		return r
+	}
+	return r.WithContext(identity.NewContext(r.Context(), id))
+}
+
+// sessionAuthentication return the authentication context recorded in the session, to be checked against step-up rules.
+// A guessed authentication time does not count: A maxAuthAge rule then requires a new login, providing an auth_time claim.
+func sessionAuthentication(r *http.Request, sessionManager *scs.SessionManager) stepup.Authentication {
+	auth := stepup.Authentication{
+		Acr: sessionManager.GetString(r.Context(), acrKey),
+		Amr: strings.Fields(sessionManager.GetString(r.Context(), amrKey)),
+	}
+	if !sessionManager.GetBool(r.Context(), authTimeGuessedKey) {
+		auth.AuthTime = sessionManager.GetTime(r.Context(), authTimeKey)
+	}
+	return auth
+}
+
+// beginLogin enter the login process. If there is more than one provider, the user is first sent to the chooser page.
+func beginLogin(w http.ResponseWriter, r *http.Request, sessionManager *scs.SessionManager, providers *oidcapp.Providers) {
+	if samlApp != nil {
+		startSamlLogin(w, r, sessionManager, r.URL.String())
+		return
+	}
+	if len(providers.List()) == 1 {
+		startLogin(w, r, sessionManager, providers.List()[0], r.URL.String())
+		return
+	}
+	log.Debugf("%s %s => Not logged. Will redirect to provider chooser", r.Method, r.URL)
+	sessionManager.Put(r.Context(), landingURLKey, r.URL.String())
+	http.Redirect(w, r, "/dg_login", http.StatusSeeOther)
+}
+
+func startLogin(w http.ResponseWriter, r *http.Request, sessionManager *scs.SessionManager, oidcApp *oidcapp.OidcApp, landingURL string) {
+	loginContext, err := oidcApp.NewLoginContext()
+	if err != nil {
+		config.Log.Errorf(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var stepUpRule *stepup.Rule
+	loginContext.AuthParams, stepUpRule = loginAuthParams(landingURL, oidcApp.PassthroughAuthParams)
+	lurl, err := oidcApp.NewLoginURL(loginContext)
+	if errors.Is(err, oidcapp.ErrNotReady) {
+		log.Warnf("%s %s => Not logged, but provider '%s' is not available yet", r.Method, r.URL, oidcApp.Name())
+		templates.RenderUnavailable(w, landingURL, unavailableRetryAfter)
+	} else if err != nil {
+		config.Log.Errorf(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	} else {
+		log.Debugf("%s %s => Not logged. Will redirect to %s", r.Method, r.URL, lurl)
+		putLoginState(r, sessionManager, oidcApp.Name(), loginContext.State, landingURL, stepUpRule)
+		sessionManager.Put(r.Context(), loginNonceKey, loginContext.Nonce)
+		sessionManager.Put(r.Context(), loginPKCEKey, loginContext.CodeVerifier)
+		http.Redirect(w, r, lurl, http.StatusSeeOther)
+	}
+}
+
+// loginAuthParams return the authorization request parameters of a login landing on landingURL: The ones passed through
+// from its query, if passthrough is not nil, and the ones of the step-up rule it requires, if any. This rule is also returned.
+func loginAuthParams(landingURL string, passthrough func(query url.Values) map[string]string) (map[string]string, *stepup.Rule) {
+	landing, _ := url.Parse(landingURL)
+	if landing == nil {
+		landing = &url.URL{}
+	}
+	authParams := make(map[string]string)
+	if passthrough != nil {
+		authParams = passthrough(landing.Query())
+	}
+	// If the landing page requires a stronger authentication, request it right now
+	stepUpRule := stepUpRules.Match(landing.Path)
+	if stepUpRule != nil {
+		for name, value := range stepUpRule.AuthParams() {
+			authParams[name] = value
+		}
+	}
+	return authParams, stepUpRule
+}
+
+// putLoginState keep in the session what the callback needs to complete a login: Its provider, state, landing URL and step-up rule
+func putLoginState(r *http.Request, sessionManager *scs.SessionManager, provider string, state string, landingURL string, stepUpRule *stepup.Rule) {
+	sessionManager.Put(r.Context(), landingURLKey, landingURL)
+	sessionManager.Put(r.Context(), loginProviderKey, provider)
+	sessionManager.Put(r.Context(), loginStateKey, state)
+	sessionManager.Put(r.Context(), loginTimeKey, time.Now())
+	if stepUpRule != nil {
+		sessionManager.Put(r.Context(), loginStepUpKey, stepUpRule.Path)
+	} else {
+		sessionManager.Remove(r.Context(), loginStepUpKey)
+	}
+}
+
+// renewTokens refresh the expired access token. Return false if the response has been handled (New login, error, ...)
+func renewTokens(w http.ResponseWriter, r *http.Request, sessionManager *scs.SessionManager, oidcApp *oidcapp.OidcApp, userFilter users.UserFilter) bool {
+	refreshToken := sessionManager.GetString(r.Context(), refreshTokenKey)
+	if refreshToken == "" {
+		log.Debugf("%s %s => Access token expired, but no refresh token. Rely on session lifetime", r.Method, r.URL)
+		return true
+	}
+	tokenData, err := oidcApp.RefreshToken(r.Context(), refreshToken, sessionManager.GetString(r.Context(), subjectKey))
+	if err != nil {
+		if errors.Is(err, oidcapp.ErrRefreshRejected) {
+			log.Infof("%s %s => Token renewal rejected (%v). Session is ended, will login again", r.Method, r.URL, err)
+			_ = sessionManager.Destroy(r.Context())
+			startLogin(w, r, sessionManager, oidcApp, r.URL.String())
 		} else {
-			log.Debugf("%s %s => Forward to target (Authenticated)", r.Method, r.URL)
-			reverseProxy.ServeHTTP(w, r)
+			log.Errorf("%s %s => Token renewal failed: %v", r.Method, r.URL, err)
+			templates.RenderError(w, http.StatusBadGateway, "Session renewal failed", err.Error(), r.URL.String())
+		}
+		return false
+	}
+	if tokenData.Claims != "" {
+		logged, err := userFilter.ValidateUser(tokenData.Claims)
+		if err != nil {
+			log.Errorf("Unable to decode claim '%s': %v", tokenData.Claims, err)
+			http.Error(w, fmt.Sprintf("Unable to decode claim '%s'", tokenData.Claims), http.StatusInternalServerError)
+			return false
+		}
+		if !logged {
+			log.Infof("%s %s => User is no more allowed after token renewal. Session is ended", r.Method, r.URL)
+			_ = sessionManager.Destroy(r.Context())
+			sessionManager.Put(r.Context(), landingURLKey, r.URL.String())
+			http.Redirect(w, r, "/dg_unallowed", http.StatusSeeOther)
+			return false
+		}
+	}
+	log.Debugf("%s %s => Access token renewed (New expiry: %s)", r.Method, r.URL, tokenData.Expiry.String())
+	storeTokens(r, sessionManager, tokenData)
+	return true
+}
+
+func clearIdentity(r *http.Request, sessionManager *scs.SessionManager) {
+	for _, key := range identityKeys {
+		sessionManager.Remove(r.Context(), key)
+	}
+}
+
+func storeTokens(r *http.Request, sessionManager *scs.SessionManager, tokenData *oidcapp.TokenData) {
+	sessionManager.Put(r.Context(), accessTokenKey, tokenData.AccessToken)
+	sessionManager.Put(r.Context(), accessTokenExpiryKey, tokenData.Expiry)
+	if tokenData.RefreshToken != "" {
+		sessionManager.Put(r.Context(), refreshTokenKey, tokenData.RefreshToken)
+	}
+	if tokenData.Claims != "" {
+		sessionManager.Put(r.Context(), claimKey, tokenData.Claims)
+	}
+	if tokenData.IDToken != "" {
+		sessionManager.Put(r.Context(), idTokenKey, tokenData.IDToken)
+	}
+	if tokenData.Subject != "" {
+		sessionManager.Put(r.Context(), subjectKey, tokenData.Subject)
+	}
+	if tokenData.Sid != "" {
+		sessionManager.Put(r.Context(), sidKey, tokenData.Sid)
+	}
+	// On renewal, the expiry of the login ID token is kept: A refresh token can't extend the session validity (capToIDToken)
+	if !tokenData.IDTokenExpiry.IsZero() && sessionManager.GetTime(r.Context(), idTokenExpiryKey).IsZero() {
+		sessionManager.Put(r.Context(), idTokenExpiryKey, tokenData.IDTokenExpiry)
+	}
+	if !tokenData.AuthTime.IsZero() {
+		sessionManager.Put(r.Context(), authTimeKey, tokenData.AuthTime)
+		sessionManager.Remove(r.Context(), authTimeGuessedKey)
+	}
+	if tokenData.Acr != "" {
+		sessionManager.Put(r.Context(), acrKey, tokenData.Acr)
+	}
+	if len(tokenData.Amr) > 0 {
+		sessionManager.Put(r.Context(), amrKey, strings.Join(tokenData.Amr, " "))
+	}
+}
+
+// Display the provider chooser page, or start the login on the chosen provider
+func loginHandler(sessionManager *scs.SessionManager, providers *oidcapp.Providers) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		landingURL := sessionManager.GetString(r.Context(), landingURLKey)
+		if landingURL == "" {
+			landingURL = "/"
+		}
+		if samlApp != nil {
+			startSamlLogin(w, r, sessionManager, landingURL)
+			return
+		}
+		name := r.URL.Query().Get("provider")
+		if name == "" && len(providers.List()) == 1 {
+			name = providers.List()[0].Name()
+		}
+		if name == "" {
+			list := make([]templates.Provider, 0, len(providers.List()))
+			for _, oidcApp := range providers.List() {
+				list = append(list, templates.Provider{Name: oidcApp.Name(), DisplayName: oidcApp.DisplayName()})
+			}
+			templates.RenderProviders(w, "/dg_login", list)
+			return
 		}
+		oidcApp := providers.Get(name)
+		if oidcApp == nil {
+			templates.RenderError(w, http.StatusBadRequest, "Login failed", fmt.Sprintf("unknown provider: %s", name), "/dg_login")
+			return
+		}
+		startLogin(w, r, sessionManager, oidcApp, landingURL)
 	})
 }
 
-func callbackHandler(sessionManager *scs.SessionManager, oidcApp *oidcapp.OidcApp, userFilter users.UserFilter) http.Handler {
+// relayCrossSitePost handle a login response posted without the session cookie. Return true if so.
+// The browser does not send the session cookie on a cross-site POST (Unless SameSite=None), such as the form_post response mode or the SAML POST binding.
+// The form is then posted again from our own page. The session must not be touched here, to not issue a new session cookie.
+func relayCrossSitePost(w http.ResponseWriter, r *http.Request, sessionManager *scs.SessionManager) bool {
+	if r.Method != http.MethodPost || r.PostFormValue(formPostRelayField) != "" {
+		return false
+	}
+	if _, err := r.Cookie(sessionManager.Cookie.Name); err == nil {
+		return false
+	}
+	log.Debugf("%s posted without session cookie. Will post it again from dexgate origin", r.URL.Path)
+	fields := url.Values{}
+	for name, values := range r.PostForm {
+		fields[name] = values
+	}
+	fields.Set(formPostRelayField, "1")
+	templates.RenderFormPost(w, "", fields)
+	return true
+}
+
+func callbackHandler(sessionManager *scs.SessionManager, providers *oidcapp.Providers, userFilter users.UserFilter) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		code, errMsg := oidcApp.CheckCallbackRequest(r)
+		if relayCrossSitePost(w, r, sessionManager) {
+			return
+		}
+		landingURL := sessionManager.GetString(r.Context(), landingURLKey)
+		// Login context is single use. Remove it from the session whatever the outcome
+		loginContext := &oidcapp.LoginContext{
+			State:        sessionManager.PopString(r.Context(), loginStateKey),
+			Nonce:        sessionManager.PopString(r.Context(), loginNonceKey),
+			CodeVerifier: sessionManager.PopString(r.Context(), loginPKCEKey),
+		}
+		loginTime := sessionManager.PopTime(r.Context(), loginTimeKey)
+		stepUpPath := sessionManager.PopString(r.Context(), loginStepUpKey)
+		oidcApp := providers.Get(sessionManager.PopString(r.Context(), loginProviderKey))
+		if oidcApp == nil {
+			log.Warnf("Invalid callback request: no pending login for this session")
+			templates.RenderError(w, http.StatusBadRequest, "Login failed", "no pending login for this session. The login state is unknown, already used or expired", landingURL)
+			return
+		}
+		if loginContext.State != "" && time.Since(loginTime) > config.LoginTimeout {
+			log.Infof("Login started at %s has expired", loginTime.String())
+			loginContext.State = ""
+		}
+		code, errMsg := oidcApp.CheckCallbackRequest(r, loginContext.State)
+		if errMsg != "" {
+			log.Warnf("Invalid callback request: %s", errMsg)
+			templates.RenderError(w, http.StatusBadRequest, "Login failed", errMsg, landingURL)
+			return
+		}
+		tokenData, errMsg := oidcApp.HandleCallbackRequest(r, code, loginContext)
 		if errMsg != "" {
-			http.Error(w, errMsg, http.StatusBadRequest)
+			log.Errorf("Unable to handle callback request: %s", errMsg)
+			templates.RenderError(w, http.StatusInternalServerError, "Login failed", errMsg, landingURL)
 			return
 		}
-		tokenData, errMsg := oidcApp.HandleCallbackRequest(r, code)
+		completeLogin(w, r, sessionManager, userFilter, oidcApp.Name(), tokenData, stepUpPath, landingURL)
+	})
+}
+
+// completeLogin check the user permissions and the step-up requirement, then store the login result in the session.
+func completeLogin(w http.ResponseWriter, r *http.Request, sessionManager *scs.SessionManager, userFilter users.UserFilter, provider string, tokenData *oidcapp.TokenData, stepUpPath string, landingURL string) {
+	log.Debugf("claims:%v", tokenData.Claims)
+	logged, err := userFilter.ValidateUser(tokenData.Claims)
+	if err != nil {
+		log.Errorf("Unable to decode claim '%s': %v", tokenData.Claims, err)
+		http.Error(w, fmt.Sprintf("Unable to decode claim '%s'", tokenData.Claims), http.StatusInternalServerError)
+		return
+	}
+	if !logged {
+		// We could render the unallowed template here. But we prefer to issue a redirect, to clean address bar from redirect callback url.
+		http.Redirect(w, r, "/dg_unallowed", http.StatusSeeOther)
+	} else {
+		// Check the IdP performed the requested authentication. Otherwise, redirecting to the landing page would loop.
+		// NB: With a maxAuthAge, auth_time is required (OIDC Core, section 3.1.2.1). So, this is checked before any fallback
+		if rule := stepUpRules.Get(stepUpPath); rule != nil {
+			auth := stepup.Authentication{Acr: tokenData.Acr, Amr: tokenData.Amr, AuthTime: tokenData.AuthTime}
+			if err := rule.Check(auth); err != nil {
+				log.Warnf("Step-up authentication for %s failed: %v", rule.Path, err)
+				templates.RenderError(w, http.StatusForbidden, "Login failed", fmt.Sprintf("the required authentication level was not reached: %v", err), "/")
+				return
+			}
+			log.Infof("Step-up authentication for %s fulfilled (acr: '%s', amr: %v, auth_time: %s)", rule.Path, auth.Acr, auth.Amr, auth.AuthTime.String())
+		}
+		authTimeGuessed := tokenData.AuthTime.IsZero()
+		if authTimeGuessed {
+			// No auth_time claim. The callback time is the best approximation, for the session cap only
+			tokenData.AuthTime = time.Now()
+		}
+		// Privilege level change. Renew the session token to prevent session fixation
+		if err := sessionManager.RenewToken(r.Context()); err != nil {
+			log.Errorf("Unable to renew session token: %v", err)
+			http.Error(w, "Unable to renew session token", http.StatusInternalServerError)
+			return
+		}
+		// Tokens and identity of a previous login in this session must not be retained
+		clearIdentity(r, sessionManager)
+		sessionManager.Put(r.Context(), providerKey, provider)
+		storeTokens(r, sessionManager, tokenData)
+		if authTimeGuessed {
+			sessionManager.Put(r.Context(), authTimeGuessedKey, true)
+		}
+		if config.Conf.TokenDisplay {
+			log.Debugf("Displaying token page (landingURL:%s)", landingURL)
+			templates.RenderToken(w, tokenData, landingURL)
+		} else {
+			log.Debugf("Redirecting to landingURL:%s)", landingURL)
+			http.Redirect(w, r, landingURL, http.StatusSeeOther)
+		}
+	}
+}
+
+// startSamlLogin send the user to the SAML IdP with an authentication request. The request ID is kept in the session, as the OIDC state.
+func startSamlLogin(w http.ResponseWriter, r *http.Request, sessionManager *scs.SessionManager, landingURL string) {
+	authParams, stepUpRule := loginAuthParams(landingURL, nil)
+	request, err := samlApp.NewLoginRequest(authParams)
+	if err != nil {
+		log.Errorf(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	putLoginState(r, sessionManager, samlapp.ProviderName, request.ID, landingURL, stepUpRule)
+	if request.Fields != nil {
+		log.Debugf("%s %s => Not logged. Will post SAML request to %s", r.Method, r.URL, request.URL)
+		templates.RenderFormPost(w, request.URL, request.Fields)
+	} else {
+		log.Debugf("%s %s => Not logged. Will redirect to %s", r.Method, r.URL, request.URL)
+		http.Redirect(w, r, request.URL, http.StatusSeeOther)
+	}
+}
+
+// SAML assertion consumer service. The IdP posts the response here (HTTP-POST binding)
+func samlACSHandler(sessionManager *scs.SessionManager, userFilter users.UserFilter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if relayCrossSitePost(w, r, sessionManager) {
+			return
+		}
+		landingURL := sessionManager.GetString(r.Context(), landingURLKey)
+		// Login context is single use. Remove it from the session whatever the outcome
+		requestID := sessionManager.PopString(r.Context(), loginStateKey)
+		loginTime := sessionManager.PopTime(r.Context(), loginTimeKey)
+		stepUpPath := sessionManager.PopString(r.Context(), loginStepUpKey)
+		if sessionManager.PopString(r.Context(), loginProviderKey) != samlapp.ProviderName {
+			requestID = ""
+		}
+		if requestID != "" && time.Since(loginTime) > config.LoginTimeout {
+			log.Infof("Login started at %s has expired", loginTime.String())
+			requestID = ""
+		}
+		loginData, errMsg := samlApp.HandleResponse(r, requestID)
 		if errMsg != "" {
-			http.Error(w, errMsg, http.StatusInternalServerError)
+			log.Warnf("Unable to handle SAML response: %s", errMsg)
+			templates.RenderError(w, http.StatusBadRequest, "Login failed", errMsg, landingURL)
+			return
+		}
+		// Stored as an OIDC login without token. The IdP session end, if any, caps the session as the ID token expiration does
+		tokenData := &oidcapp.TokenData{
+			Subject:       loginData.Subject,
+			Sid:           loginData.SessionIndex,
+			AuthTime:      loginData.AuthTime,
+			Acr:           loginData.Acr,
+			IDTokenExpiry: loginData.SessionExpiry,
+			Claims:        loginData.Claims,
+		}
+		completeLogin(w, r, sessionManager, userFilter, samlapp.ProviderName, tokenData, stepUpPath, landingURL)
+	})
+}
+
+// SAML service provider metadata, to be registered in the IdP
+func samlMetadataHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metadata, err := samlApp.Metadata()
+		if err != nil {
+			log.Errorf("Unable to build SAML metadata: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/samlmetadata+xml")
+		_, _ = w.Write(metadata)
+	})
+}
+
+func lougoutHandler(sessionManager *scs.SessionManager, providers *oidcapp.Providers) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		landingURL := sessionManager.GetString(r.Context(), landingURLKey)
+		idToken := sessionManager.GetString(r.Context(), idTokenKey)
+		oidcApp := providers.Get(sessionManager.GetString(r.Context(), providerKey))
+		if oidcApp == nil && len(providers.List()) == 1 {
+			oidcApp = providers.List()[0]
+		}
+		_ = sessionManager.Destroy(r.Context())
+		var logoutURL, postLogoutRedirectURL string
+		if oidcApp != nil {
+			var err error
+			if logoutURL, err = oidcApp.NewLogoutURL(idToken); err != nil {
+				log.Errorf("Unable to build logout URL: %v", err)
+			}
+			postLogoutRedirectURL = oidcApp.PostLogoutRedirectURL()
+		}
+		if logoutURL != "" {
+			log.Debugf("Local session destroyed. Redirecting to OIDC server logout: %s", logoutURL)
+			http.Redirect(w, r, logoutURL, http.StatusSeeOther)
+		} else if postLogoutRedirectURL != "" {
+			log.Debugf("Local session destroyed. Redirecting to %s", postLogoutRedirectURL)
+			http.Redirect(w, r, postLogoutRedirectURL, http.StatusSeeOther)
+		} else {
+			templates.RenderLogout(w, landingURL)
+		}
+	})
+}
+
+// Start a device authorization grant (RFC 8628), for a CLI without browser. The provider may be selected with the 'provider' parameter.
+// Respond in JSON if requested so by the Accept header. Otherwise, in plain text, for a human.
+// As each request is relayed to the OIDC server, only POST is accepted, and the requests are rate-limited per client address.
+func deviceHandler(providers *oidcapp.Providers, limiter *ratelimit.Limiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method != http.MethodPost {
+			http.Error(w, fmt.Sprintf("method not allowed: %s", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		if allowed, retryAfter := limiter.Allow(client); !allowed {
+			log.Warnf("Too many device authorization requests from %s", client)
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(retryAfter.Seconds())+1))
+			writeJSONError(w, http.StatusTooManyRequests, "slow_down", "too many device authorization requests")
+			return
+		}
+		name := r.FormValue("provider")
+		if name == "" && len(providers.List()) == 1 {
+			name = providers.List()[0].Name()
+		}
+		oidcApp := providers.Get(name)
+		if oidcApp == nil {
+			names := make([]string, 0, len(providers.List()))
+			for _, p := range providers.List() {
+				names = append(names, p.Name())
+			}
+			writeJSONError(w, http.StatusBadRequest, "invalid_request", fmt.Sprintf("'provider' parameter must be one of: %s", strings.Join(names, ", ")))
+			return
+		}
+		authorization, err := oidcApp.StartDeviceAuthorization(r.Context())
+		if errors.Is(err, oidcapp.ErrTooManyPending) {
+			log.Warnf("Device authorization refused on provider '%s': %v", oidcApp.Name(), err)
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", unavailableRetryAfter))
+			writeJSONError(w, http.StatusServiceUnavailable, "temporarily_unavailable", err.Error())
+			return
+		} else if errors.Is(err, oidcapp.ErrNotReady) {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", unavailableRetryAfter))
+			writeJSONError(w, http.StatusServiceUnavailable, "temporarily_unavailable", err.Error())
+			return
+		} else if err != nil {
+			log.Errorf("Unable to start device authorization on provider '%s': %v", oidcApp.Name(), err)
+			writeJSONError(w, http.StatusBadGateway, "server_error", err.Error())
+			return
+		}
+		// Bind the device code to the provider, for polling
+		authorization.DeviceCode = oidcApp.Name() + "." + authorization.DeviceCode
+		log.Debugf("Device authorization started on provider '%s' (user_code:'%s')", oidcApp.Name(), authorization.UserCode)
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			writeJSON(w, http.StatusOK, authorization)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		verificationURI := authorization.VerificationURIComplete
+		if verificationURI == "" {
+			verificationURI = authorization.VerificationURI
+		}
+		_, _ = fmt.Fprintf(w, "To login, open %s in a browser and enter the code: %s\n\n", verificationURI, authorization.UserCode)
+		_, _ = fmt.Fprintf(w, "Then, every %d seconds until success, POST device_code=%s to /dg_device/token\n", authorization.Interval, authorization.DeviceCode)
+		_, _ = fmt.Fprintf(w, "This code expires in %d seconds.\n", authorization.ExpiresIn)
+	})
+}
+
+// Polled by the CLI, up to the user approval. Then, a session is created and its token is provided, to be sent as the session cookie.
+// Errors are reported as defined in RFC 8628, section 3.5
+func deviceTokenHandler(sessionManager *scs.SessionManager, providers *oidcapp.Providers, userFilter users.UserFilter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method != http.MethodPost {
+			http.Error(w, fmt.Sprintf("method not allowed: %s", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		parts := strings.SplitN(r.PostFormValue("device_code"), ".", 2)
+		var oidcApp *oidcapp.OidcApp
+		if len(parts) == 2 {
+			oidcApp = providers.Get(parts[0])
+		}
+		if oidcApp == nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid_grant", "missing or invalid device_code")
+			return
+		}
+		tokenData, err := oidcApp.PollDeviceToken(r.Context(), parts[1])
+		if err != nil {
+			var deviceError *oidcapp.DeviceError
+			if errors.As(err, &deviceError) {
+				if !deviceError.Pending() {
+					log.Infof("Device authorization on provider '%s' failed: %v", oidcApp.Name(), deviceError)
+				}
+				writeJSON(w, http.StatusBadRequest, deviceError)
+			} else {
+				log.Errorf("Device authorization on provider '%s' failed: %v", oidcApp.Name(), err)
+				writeJSONError(w, http.StatusBadGateway, "server_error", err.Error())
+			}
 			return
 		}
-		log.Debugf("claims:%v", tokenData.Claims)
 		logged, err := userFilter.ValidateUser(tokenData.Claims)
 		if err != nil {
 			log.Errorf("Unable to decode claim '%s': %v", tokenData.Claims, err)
-			http.Error(w, fmt.Sprintf("Unable to decode claim '%s'", tokenData.Claims), http.StatusInternalServerError)
+			writeJSONError(w, http.StatusInternalServerError, "server_error", "unable to decode claims")
 			return
 		}
-		landingURL := sessionManager.GetString(r.Context(), landingURLKey)
 		if !logged {
-			// We could render the unallowed template here. But we prefer to issue a redirect, to clean address bar from redirect callback url.
-			http.Redirect(w, r, "dg_unallowed", http.StatusSeeOther)
+			writeJSONError(w, http.StatusForbidden, "access_denied", "User is not allowed to access this resource")
+			return
+		}
+		if err := sessionManager.RenewToken(r.Context()); err != nil {
+			log.Errorf("Unable to renew session token: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "server_error", "unable to create session")
+			return
+		}
+		authTimeGuessed := tokenData.AuthTime.IsZero()
+		if authTimeGuessed {
+			tokenData.AuthTime = time.Now()
+		}
+		clearIdentity(r, sessionManager)
+		sessionManager.Put(r.Context(), providerKey, oidcApp.Name())
+		storeTokens(r, sessionManager, tokenData)
+		if authTimeGuessed {
+			sessionManager.Put(r.Context(), authTimeGuessedKey, true)
+		}
+		sessionToken, expiry, err := sessionManager.Commit(r.Context())
+		if err != nil {
+			log.Errorf("Unable to commit session: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "server_error", "unable to create session")
+			return
+		}
+		response := map[string]interface{}{
+			"session_cookie": sessionManager.Cookie.Name,
+			"session":        sessionToken,
+			"expires_at":     expiry.Unix(),
+		}
+		if config.Conf.Bearer.Enabled && oidcapp.ContainsOneOf(oidcApp.BearerAudiences(), []string{oidcApp.ClientID()}) {
+			// Usable as bearer token, as its audience (The client ID) is an allowed one
+			response["id_token"] = tokenData.IDToken
+		}
+		log.Infof("Device authorization on provider '%s' succeeded (sub:'%s')", oidcApp.Name(), tokenData.Subject)
+		writeJSON(w, http.StatusOK, response)
+	})
+}
+
+// Publish the public keys used for client authentication. Built on each request, to reflect key rotation
+func jwksHandler(providers *oidcapp.Providers) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		writeJSON(w, http.StatusOK, oidcapp.PublicJWKS(providers))
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, code string, description string) {
+	writeJSON(w, status, map[string]string{"error": code, "error_description": description})
+}
+
+// Called server to server by the OIDC server. See https://openid.net/specs/openid-connect-backchannel-1_0.html
+func backChannelLogoutHandler(sessionStore *sessions.IndexedStore, providers *oidcapp.Providers) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method != http.MethodPost {
+			http.Error(w, fmt.Sprintf("method not allowed: %s", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		rawLogoutToken := r.PostFormValue("logout_token")
+		var logoutToken *oidcapp.LogoutToken
+		oidcApp, err := providers.ForToken(rawLogoutToken)
+		if err == nil {
+			logoutToken, err = oidcApp.VerifyLogoutToken(r.Context(), rawLogoutToken)
+		}
+		if err != nil {
+			log.Warnf("Back-channel logout rejected: %v", err)
+			writeJSONError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		var count int
+		if logoutToken.Sid != "" {
+			count, err = sessionStore.DestroyBySid(oidcApp.Name(), logoutToken.Sid)
 		} else {
-			sessionManager.Put(r.Context(), accessTokenKey, tokenData.AccessToken)
-			sessionManager.Put(r.Context(), claimKey, tokenData.Claims)
-			if config.Conf.TokenDisplay {
-				log.Debugf("Displaying token page (landingURL:%s)", landingURL)
-				templates.RenderToken(w, tokenData, landingURL)
-			} else {
-				log.Debugf("Redirecting to landingURL:%s)", landingURL)
-				http.Redirect(w, r, landingURL, http.StatusSeeOther)
+			count, err = sessionStore.DestroyBySubject(oidcApp.Name(), logoutToken.Subject)
+		}
+		if err != nil {
+			log.Errorf("Back-channel logout (sub:'%s', sid:'%s'): Unable to destroy sessions: %v", logoutToken.Subject, logoutToken.Sid, err)
+			http.Error(w, "Unable to destroy sessions", http.StatusInternalServerError)
+			return
+		}
+		log.Infof("Back-channel logout (sub:'%s', sid:'%s'): %d session(s) destroyed", logoutToken.Subject, logoutToken.Sid, count)
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// Loaded by the user's browser in an iframe, on OIDC server logout. See https://openid.net/specs/openid-connect-frontchannel-1_0.html
+// NB: For the session cookie to be sent in a cross-site iframe, sessionConfig.cookieSameSite must be 'None'
+// The request is not authenticated. So, only the session of the requesting browser is cleared. Server side destruction is
+// the job of back-channel logout.
+func frontChannelLogoutHandler(sessionManager *scs.SessionManager, providers *oidcapp.Providers) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		iss := r.URL.Query().Get("iss")
+		sid := r.URL.Query().Get("sid")
+		sessionProvider := sessionManager.GetString(r.Context(), providerKey)
+		// Without iss, the provider can only be the one of this browser session
+		provider := sessionProvider
+		if iss != "" {
+			oidcApp := providers.GetByIssuer(iss)
+			if oidcApp == nil {
+				log.Warnf("Front-channel logout rejected: unknown issuer '%s'", iss)
+				http.Error(w, fmt.Sprintf("unknown issuer: %s", iss), http.StatusBadRequest)
+				return
 			}
+			provider = oidcApp.Name()
+		}
+		loggedOut := false
+		sessionSid := sessionManager.GetString(r.Context(), sidKey)
+		if sessionManager.GetString(r.Context(), accessTokenKey) != "" && provider == sessionProvider && (sid == "" || sid == sessionSid) {
+			// Session of this browser. Destroying it will also clear the cookie
+			_ = sessionManager.Destroy(r.Context())
+			loggedOut = true
 		}
+		log.Infof("Front-channel logout (sid:'%s'): session found: %t", sid, loggedOut)
+		templates.RenderFrontChannelLogout(w, loggedOut)
 	})
 }
 
-func lougoutHandler(sessionManager *scs.SessionManager) http.Handler {
+// Readiness probe. Ready once all OIDC providers have been successfully discovered.
+func readyHandler(providers *oidcapp.Providers) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		landingURL := sessionManager.GetString(r.Context(), landingURLKey)
-		_ = sessionManager.Destroy(r.Context())
-		templates.RenderLogout(w, landingURL)
+		status := make(map[string]bool)
+		ready := true
+		for _, oidcApp := range providers.List() {
+			status[oidcApp.Name()] = oidcApp.Ready()
+			ready = ready && status[oidcApp.Name()]
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json")
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"ready": ready, "providers": status})
+	})
+}
+
+// Metrics, in Prometheus text format
+func metricsHandler(providers *oidcapp.Providers) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		now := time.Now()
+		var age, fetchedAt, failures strings.Builder
+		for _, oidcApp := range providers.List() {
+			status := oidcApp.MetadataStatus()
+			if !status.FetchedAt.IsZero() {
+				_, _ = fmt.Fprintf(&age, "dexgate_oidc_metadata_age_seconds{provider=%q} %f\n", oidcApp.Name(), now.Sub(status.FetchedAt).Seconds())
+				_, _ = fmt.Fprintf(&fetchedAt, "dexgate_oidc_metadata_fetch_timestamp_seconds{provider=%q} %d\n", oidcApp.Name(), status.FetchedAt.Unix())
+			}
+			_, _ = fmt.Fprintf(&failures, "dexgate_oidc_metadata_refresh_failures_total{provider=%q} %d\n", oidcApp.Name(), status.RefreshFailures)
+		}
+		_, _ = fmt.Fprintf(w, "# HELP dexgate_oidc_metadata_age_seconds Time since the OIDC provider metadata in use were fetched.\n# TYPE dexgate_oidc_metadata_age_seconds gauge\n%s", age.String())
+		_, _ = fmt.Fprintf(w, "# HELP dexgate_oidc_metadata_fetch_timestamp_seconds When the OIDC provider metadata in use were fetched.\n# TYPE dexgate_oidc_metadata_fetch_timestamp_seconds gauge\n%s", fetchedAt.String())
+		_, _ = fmt.Fprintf(w, "# HELP dexgate_oidc_metadata_refresh_failures_total Number of failed OIDC provider metadata refreshes.\n# TYPE dexgate_oidc_metadata_refresh_failures_total counter\n%s", failures.String())
+	})
+}
+
+// Built-in page, which can be used as post logout landing page
+func loggedOutHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		templates.RenderLogout(w, "/")
 	})
 }
 
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"context"
+	"dexgate/internal/config"
+	"dexgate/internal/oidcapp"
+	"dexgate/pkg/devissuer"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// End-to-end tests: dexgate is configured from a file, and logs users in on the dev issuer. All servers run in process.
+
+// Validity of the tokens issued by the dev issuer. Short, for the refresh to be tested
+const testTokenTTL = 2 * time.Second
+
+// Client secret of dexgate on the dev issuer. With special characters, which are form-urlencoded in basic credentials
+const testClientSecret = "se:cr+et/%"
+
+var (
+	testIssuer    *httptest.Server
+	testGate      *httptest.Server
+	testRefreshes int32 // Refresh token grants received by the issuer
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	dir, err := ioutil.TempDir("", "dexgate-test")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 2
+	}
+	defer os.RemoveAll(dir)
+
+	// The target application echoes the request path and the user identity
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "%s user=%s groups=%s email=%s", r.URL.Path,
+			r.Header.Get("X-Forwarded-User"), r.Header.Get("X-Forwarded-Groups"), r.Header.Get("X-Forwarded-Email"))
+	}))
+	defer target.Close()
+	// Both URLs are required by the configurations. So, listen before starting the servers
+	testIssuer = httptest.NewUnstartedServer(nil)
+	testGate = httptest.NewUnstartedServer(nil)
+	issuerURL := "http://" + testIssuer.Listener.Addr().String()
+	gateURL := "http://" + testGate.Listener.Addr().String()
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "users.yml"), []byte("allowedGroups: [developers]\n"), 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 2
+	}
+	conf := fmt.Sprintf(`logLevel: WARN
+logMode: dev
+targetURL: %s
+usersConfigFile: users.yml
+identityHeaders:
+  username: X-Forwarded-User
+  email: X-Forwarded-Email
+  groups: X-Forwarded-Groups
+oidc:
+  clientID: dexgate
+  clientSecret: %q
+  issuerURL: %s
+  redirectURL: %s/dg_callback
+  # The ID token is issued for the 'peer' cross-client, on behalf of dexgate
+  scopes: [profile, email, groups, offline_access, "audience:server:client_id:peer"]
+  tokenValidation:
+    audiences: [peer]
+    authorizedParties: [dexgate, cli]
+bearer:
+  enabled: true
+stepUp:
+  - path: /admin
+    acr: [mfa]
+`, target.URL, testClientSecret, issuerURL, gateURL)
+	configFile := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(configFile, []byte(conf), 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 2
+	}
+	// Setup() parses the command line
+	args := os.Args
+	os.Args = []string{args[0], "--config", configFile}
+	config.Setup()
+	os.Args = args
+	log = config.Log
+
+	issuer, err := devissuer.New(&devissuer.Config{
+		Issuer:   issuerURL,
+		TokenTTL: testTokenTTL.String(),
+		Clients: []devissuer.ClientConfig{
+			{ID: "dexgate", Secret: testClientSecret, RedirectURIs: []string{gateURL + "/dg_callback"}},
+			{ID: "cli"},
+			{ID: "other"},
+		},
+		Users: []devissuer.UserConfig{
+			{Login: "john", Password: "john123", Name: "John", Email: "john@example.com", Groups: []string{"developers"}},
+			{Login: "jane", Password: "jane123", Name: "Jane", Email: "jane@example.com", Groups: []string{"sales"}},
+			{Login: "jim", Password: "jim123", Name: "Jim", Email: "jim@example.com", EmailUnverified: true, Groups: []string{"developers"}},
+		},
+	}, config.Log)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 2
+	}
+	testIssuer.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" && r.FormValue("grant_type") == "refresh_token" {
+			atomic.AddInt32(&testRefreshes, 1)
+		}
+		issuer.ServeHTTP(w, r)
+	})
+	testIssuer.Start()
+	defer testIssuer.Close()
+
+	handler, userFilter := newHandler()
+	defer userFilter.Close()
+	testGate.Config.Handler = handler
+	testGate.Start()
+	defer testGate.Close()
+	// Discovery is performed in background
+	for i := 0; ; i++ {
+		resp, err := http.Get(testGate.URL + "/dg_ready")
+		if err == nil {
+			_ = resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		if i == 50 {
+			fmt.Fprintf(os.Stderr, "ERROR: dexgate is not ready\n")
+			return 2
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return m.Run()
+}
+
+// newBrowser return a client keeping the cookies and following the redirects, as a browser would
+func newBrowser(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+// get request a dexgate page, and return the final response status, URL and body
+func get(t *testing.T, client *http.Client, path string) (int, *url.URL, string) {
+	resp, err := client.Get(testGate.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readResponse(t, resp)
+}
+
+// login submit the dev issuer login form, reached by a previous request. Return the final response, after the callback
+func login(t *testing.T, client *http.Client, loginPage *url.URL, user string, password string) (int, *url.URL, string) {
+	if !strings.HasPrefix(loginPage.String(), testIssuer.URL+"/auth?") {
+		t.Fatalf("expected the issuer login page, got %s", loginPage)
+	}
+	resp, err := client.PostForm(loginPage.String(), url.Values{"login": {user}, "password": {password}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readResponse(t, resp)
+}
+
+func readResponse(t *testing.T, resp *http.Response) (int, *url.URL, string) {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, resp.Request.URL, string(body)
+}
+
+func TestLogin(t *testing.T) {
+	client := newBrowser(t)
+	_, loginPage, _ := get(t, client, "/app/page?x=1")
+	status, landing, body := login(t, client, loginPage, "john", "john123")
+	if status != http.StatusOK || landing.String() != testGate.URL+"/app/page?x=1" {
+		t.Fatalf("expected to land on the requested page, got %d %s: %s", status, landing, body)
+	}
+	if body != "/app/page user=John groups=developers email=john@example.com" {
+		t.Errorf("unexpected target response: %s", body)
+	}
+	// The session is now established
+	if status, _, body = get(t, client, "/other"); status != http.StatusOK || body != "/other user=John groups=developers email=john@example.com" {
+		t.Errorf("unexpected response in session: %d %s", status, body)
+	}
+}
+
+func TestLoginUnverifiedEmail(t *testing.T) {
+	client := newBrowser(t)
+	_, loginPage, _ := get(t, client, "/app")
+	// The email is not provided to the target application, as the IdP did not verify it
+	if _, _, body := login(t, client, loginPage, "jim", "jim123"); body != "/app user=Jim groups=developers email=" {
+		t.Errorf("unexpected target response: %s", body)
+	}
+}
+
+func TestIdentityHeadersFromClient(t *testing.T) {
+	client := newBrowser(t)
+	_, loginPage, _ := get(t, client, "/app")
+	if _, _, body := login(t, client, loginPage, "jim", "jim123"); !strings.HasPrefix(body, "/app user=Jim") {
+		t.Fatalf("unexpected target response: %s", body)
+	}
+	// A client can't provide its own email, even when the verified one is not sent
+	req, err := http.NewRequest(http.MethodGet, testGate.URL+"/app", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Forwarded-Email", "john@example.com")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, body := readResponse(t, resp); body != "/app user=Jim groups=developers email=" {
+		t.Errorf("unexpected target response: %s", body)
+	}
+}
+
+func TestLoginUnallowedUser(t *testing.T) {
+	client := newBrowser(t)
+	_, loginPage, _ := get(t, client, "/app")
+	_, landing, body := login(t, client, loginPage, "jane", "jane123")
+	if landing.Path != "/dg_unallowed" {
+		t.Errorf("expected the unallowed page, got %s: %s", landing, body)
+	}
+}
+
+// issuerCallback submit the dev issuer login form, and return the callback URL it redirects to, without following it
+func issuerCallback(t *testing.T, client *http.Client, loginPage *url.URL, user string, password string) *url.URL {
+	noRedirect := &http.Client{Jar: client.Jar, CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirect.PostForm(loginPage.String(), url.Values{"login": {user}, "password": {password}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	callback, err := resp.Location()
+	if err != nil || !strings.HasPrefix(callback.String(), testGate.URL+"/dg_callback?") {
+		t.Fatalf("expected a redirection to the callback, got %v %v", callback, err)
+	}
+	return callback
+}
+
+// The state and nonce bind a callback to the session which started the login
+func TestLoginBinding(t *testing.T) {
+	// PKCE would also reject a code issued to another session. Disabled, for the nonce check to be the tested one
+	pkce := config.Conf.OidcConfigs[0].PKCE
+	disabled := false
+	config.Conf.OidcConfigs[0].PKCE = &disabled
+	defer func() { config.Conf.OidcConfigs[0].PKCE = pkce }()
+
+	withState := func(callback *url.URL, state string) *url.URL {
+		u := *callback
+		query := u.Query()
+		if state == "" {
+			query.Del("state")
+		} else {
+			query.Set("state", state)
+		}
+		u.RawQuery = query.Encode()
+		return &u
+	}
+	tests := []struct {
+		name     string
+		callback func(own *url.URL, other *url.URL) *url.URL // The callback delivered to the session
+		status   int
+		error    string
+	}{
+		{"own callback", func(own, other *url.URL) *url.URL { return own }, http.StatusOK, ""},
+		{"callback of another session", func(own, other *url.URL) *url.URL { return other }, http.StatusBadRequest, "login state does not match"},
+		{"code of another session", func(own, other *url.URL) *url.URL { return withState(other, own.Query().Get("state")) }, http.StatusInternalServerError, "nonce does not match"},
+		{"no state", func(own, other *url.URL) *url.URL { return withState(own, "") }, http.StatusBadRequest, "no state in request"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, other := newBrowser(t), newBrowser(t)
+			_, loginPage, _ := get(t, client, "/app")
+			_, otherLoginPage, _ := get(t, other, "/app")
+			ownCallback := issuerCallback(t, client, loginPage, "john", "john123")
+			otherCallback := issuerCallback(t, other, otherLoginPage, "john", "john123")
+			resp, err := client.Get(test.callback(ownCallback, otherCallback).String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			status, landing, body := readResponse(t, resp)
+			if status != test.status || !strings.Contains(body, test.error) {
+				t.Fatalf("expected %d '%s', got %d %s: %s", test.status, test.error, status, landing, body)
+			}
+			// The login context is single use: Replaying the callback fails
+			resp, err = client.Get(ownCallback.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status, _, body = readResponse(t, resp); status != http.StatusBadRequest || !strings.Contains(body, "no pending login") {
+				t.Errorf("expected the replayed callback to be rejected, got %d: %s", status, body)
+			}
+		})
+	}
+}
+
+func TestStepUp(t *testing.T) {
+	client := newBrowser(t)
+	_, loginPage, _ := get(t, client, "/app")
+	if _, _, body := login(t, client, loginPage, "john", "john123"); body != "/app user=John groups=developers email=john@example.com" {
+		t.Fatalf("unexpected target response: %s", body)
+	}
+	// The session acr does not fulfill the rule. A new login is requested, with the required authentication context
+	_, loginPage, _ = get(t, client, "/admin/users")
+	if loginPage.Query().Get("acr_values") != "mfa" {
+		t.Fatalf("expected a login request with acr_values=mfa, got %s", loginPage)
+	}
+	status, landing, body := login(t, client, loginPage, "john", "john123")
+	if status != http.StatusOK || landing.Path != "/admin/users" || body != "/admin/users user=John groups=developers email=john@example.com" {
+		t.Fatalf("expected to land on the step-up page, got %d %s: %s", status, landing, body)
+	}
+	// Then the session fulfills the rule
+	if _, landing, _ = get(t, client, "/admin/groups"); landing.Path != "/admin/groups" {
+		t.Errorf("expected no new login, got %s", landing)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	client := newBrowser(t)
+	_, loginPage, _ := get(t, client, "/app")
+	if _, _, body := login(t, client, loginPage, "john", "john123"); body != "/app user=John groups=developers email=john@example.com" {
+		t.Fatalf("unexpected target response: %s", body)
+	}
+	refreshes := atomic.LoadInt32(&testRefreshes)
+	time.Sleep(testTokenTTL + time.Second)
+	status, landing, body := get(t, client, "/app")
+	if status != http.StatusOK || landing.String() != testGate.URL+"/app" || body != "/app user=John groups=developers email=john@example.com" {
+		t.Fatalf("expected the session to be renewed, got %d %s: %s", status, landing, body)
+	}
+	if atomic.LoadInt32(&testRefreshes) == refreshes {
+		t.Errorf("the access token has not been refreshed")
+	}
+}
+
+func TestCapToIDToken(t *testing.T) {
+	config.Conf.SessionConfig.CapToIDToken = true
+	defer func() { config.Conf.SessionConfig.CapToIDToken = false }()
+	client := newBrowser(t)
+	_, loginPage, _ := get(t, client, "/app")
+	if _, _, body := login(t, client, loginPage, "john", "john123"); body != "/app user=John groups=developers email=john@example.com" {
+		t.Fatalf("unexpected target response: %s", body)
+	}
+	refreshes := atomic.LoadInt32(&testRefreshes)
+	time.Sleep(testTokenTTL + time.Second)
+	// The refresh token can't extend the session beyond the ID token of the login
+	_, landing, _ := get(t, client, "/app")
+	if !strings.HasPrefix(landing.String(), testIssuer.URL+"/auth?") {
+		t.Fatalf("expected a new login, landed on %s", landing)
+	}
+	if atomic.LoadInt32(&testRefreshes) != refreshes {
+		t.Errorf("the access token has been refreshed")
+	}
+}
+
+// issuerToken log a user in on the dev issuer as a given client, and return the issued ID token
+func issuerToken(t *testing.T, clientID string, scopes string) string {
+	// Registered for dexgate. The other clients accept any redirect URI
+	redirectURI := testGate.URL + "/dg_callback"
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.PostForm(testIssuer.URL+"/auth", url.Values{
+		"client_id":     {clientID},
+		"redirect_uri":  {redirectURI},
+		"response_type": {"code"},
+		"scope":         {"openid " + scopes},
+		"login":         {"john"},
+		"password":      {"john123"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	location, err := resp.Location()
+	if err != nil {
+		t.Fatalf("no redirection from the issuer login: %v", err)
+	}
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"client_id":    {clientID},
+		"code":         {location.Query().Get("code")},
+		"redirect_uri": {redirectURI},
+	}
+	if clientID == "dexgate" {
+		form.Set("client_secret", testClientSecret)
+	}
+	resp, err = http.PostForm(testIssuer.URL+"/token", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil || token.IDToken == "" {
+		t.Fatalf("no ID token from the issuer (%d): %v", resp.StatusCode, err)
+	}
+	return token.IDToken
+}
+
+func TestBearer(t *testing.T) {
+	tests := []struct {
+		name     string
+		clientID string
+		scopes   string
+		status   int
+	}{
+		{"dexgate client", "dexgate", "", http.StatusOK},
+		{"cross-client peer", "dexgate", "audience:server:client_id:peer", http.StatusOK},
+		{"authorized party", "cli", "audience:server:client_id:dexgate", http.StatusOK},
+		{"unauthorized party", "other", "audience:server:client_id:dexgate", http.StatusUnauthorized},
+		{"other audience", "cli", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, testGate.URL+"/api", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+issuerToken(t, test.clientID, test.scopes))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			status, _, body := readResponse(t, resp)
+			if status != test.status {
+				t.Fatalf("expected status %d, got %d: %s", test.status, status, body)
+			}
+			if status == http.StatusOK && body != "/api user=John groups=developers email=john@example.com" {
+				t.Errorf("unexpected target response: %s", body)
+			}
+		})
+	}
+}
+
+type errorValidator struct {
+	err error
+}
+
+func (v errorValidator) Validate(ctx context.Context, token string) (string, error) {
+	return "", v.err
+}
+
+func TestBearerValidationError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"invalid token", errors.New("invalid signature"), http.StatusUnauthorized},
+		{"provider not ready", fmt.Errorf("provider 'default': %w", oidcapp.ErrNotReady), http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			serveBearer(w, httptest.NewRequest(http.MethodGet, "/api", nil), "token", nil, errorValidator{test.err}, nil)
+			if w.Code != test.status {
+				t.Fatalf("expected status %d, got %d", test.status, w.Code)
+			}
+			if test.status == http.StatusServiceUnavailable && (w.Header().Get("Retry-After") == "" || w.Header().Get("WWW-Authenticate") != "") {
+				t.Errorf("unexpected headers: %v", w.Header())
+			}
+		})
+	}
+}
+
+// Basic client credentials are form-urlencoded (RFC 6749, section 2.3.1). An unknown code must fail on the grant, not on the client
+func TestDevIssuerBasicAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		error  string
+	}{
+		{"encoded secret", url.QueryEscape(testClientSecret), "invalid_grant"},
+		{"raw secret", testClientSecret, "invalid_client"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			form := url.Values{"grant_type": {"authorization_code"}, "code": {"unknown"}}
+			req, _ := http.NewRequest(http.MethodPost, testIssuer.URL+"/token", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.SetBasicAuth("dexgate", test.secret)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var tokenError struct {
+				Error string `json:"error"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&tokenError); err != nil {
+				t.Fatal(err)
+			}
+			if tokenError.Error != test.error {
+				t.Errorf("expected a '%s' error, got '%s'", test.error, tokenError.Error)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package configwatcher
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"time"
+)
+
+/*
+ pollingFileWatcher read the file periodically, and notify when its content change.
+ Unlike configFileWatcher, this is robust to file replacement (rename, Kubernetes secret/configMap volume symlinks swap, ...),
+ at the cost of a reload delay.
+*/
+
+type pollingFileWatcher struct {
+	filePath string
+	interval time.Duration
+	last     []byte
+	done     chan struct{}
+	log      *logrus.Entry
+}
+
+func NewPollingFileWatcher(filePath string, interval time.Duration, log *logrus.Entry) (ConfigWatcher, error) {
+	return &pollingFileWatcher{
+		filePath: filePath,
+		interval: interval,
+		done:     make(chan struct{}),
+		log:      log,
+	}, nil
+}
+
+func (this *pollingFileWatcher) Get() (string, error) {
+	data, err := ioutil.ReadFile(this.filePath)
+	if err != nil {
+		return "", fmt.Errorf("watcher on '%s': Unable to read '%s': '%v'", this.GetName(), this.filePath, err)
+	}
+	this.last = data
+	return string(data), nil
+}
+
+func (this *pollingFileWatcher) GetName() string {
+	return fmt.Sprintf("file://%s", this.filePath)
+}
+
+func (this *pollingFileWatcher) Watch(callback func(data string)) error {
+	go func() {
+		ticker := time.NewTicker(this.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-this.done:
+				return
+			case <-ticker.C:
+				data, err := ioutil.ReadFile(this.filePath)
+				if err != nil {
+					this.log.Errorf("watcher on '%s': Error on reading file: '%v'. Keep old version", this.GetName(), err)
+					continue
+				}
+				if !bytes.Equal(data, this.last) {
+					this.log.Debugf("watcher on '%s': modified file", this.GetName())
+					this.last = data
+					callback(string(data))
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (this *pollingFileWatcher) Close() {
+	close(this.done)
+}
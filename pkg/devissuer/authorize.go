@@ -0,0 +1,193 @@
+package devissuer
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Authorization request parameters, carried along the login form
+var authParams = []string{"client_id", "redirect_uri", "response_type", "response_mode", "scope", "state", "nonce", "code_challenge", "code_challenge_method", "acr_values", "login_hint"}
+
+var loginTmpl = template.Must(template.New("login.html").Parse(`<html>
+  <head>
+    <title>Dev issuer login</title>
+  </head>
+  <body>
+	<h3>Dev issuer login</h3>
+	<p>Client: <code>{{ .ClientID }}</code></p>
+	{{ if .Error }}<p style="color: red">{{ .Error }}</p>{{ end }}
+	<form method="post">
+	{{ range $name, $values := .Params }}{{ range $values }}
+	  <input type="hidden" name="{{ $name }}" value="{{ . }}">
+	{{ end }}{{ end }}
+	  <p><label>Login <input type="text" name="login" value="{{ .Login }}" autofocus></label></p>
+	  <p><label>Password <input type="password" name="password"></label></p>
+	  <p><input type="submit" value="Login"></p>
+	</form>
+	<p>Users: {{ range .Users }}<code>{{ .Login }}</code> {{ end }}</p>
+  </body>
+</html>
+`))
+
+var formPostTmpl = template.Must(template.New("formpost.html").Parse(`<html>
+  <body onload="document.forms[0].submit()">
+	<form method="post" action="{{ .Action }}">
+	{{ range $name, $values := .Fields }}{{ range $values }}
+	  <input type="hidden" name="{{ $name }}" value="{{ . }}">
+	{{ end }}{{ end }}
+	  <noscript><input type="submit" value="CONTINUE"></noscript>
+	</form>
+  </body>
+</html>
+`))
+
+type loginTmplData struct {
+	ClientID string
+	Params   url.Values
+	Login    string
+	Error    string
+	Users    []UserConfig
+}
+
+// handleAuthorization display the login form (GET) and handle its submission (POST). Each authorization request requires a login:
+// There is no SSO session, so 'prompt' and 'max_age' are always fulfilled.
+func (issuer *Issuer) handleAuthorization(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	params := url.Values{}
+	for _, name := range authParams {
+		if value := r.Form.Get(name); value != "" {
+			params.Set(name, value)
+		}
+	}
+	// Errors on client or redirect URI can't be reported to the client
+	client, ok := issuer.config.client(params.Get("client_id"))
+	if !ok {
+		http.Error(w, "Unknown client_id", http.StatusBadRequest)
+		return
+	}
+	redirectURI := params.Get("redirect_uri")
+	if !client.allowRedirectURI(redirectURI) {
+		http.Error(w, "Unregistered redirect_uri", http.StatusBadRequest)
+		return
+	}
+	responseMode := params.Get("response_mode")
+	if responseMode != "" && responseMode != "query" && responseMode != "form_post" {
+		http.Error(w, "Unsupported response_mode", http.StatusBadRequest)
+		return
+	}
+	if params.Get("response_type") != "code" {
+		issuer.authorizationError(w, r, params, "unsupported_response_type", "only 'code' response type is supported")
+		return
+	}
+	scopes := strings.Fields(params.Get("scope"))
+	if !contains(scopes, "openid") {
+		issuer.authorizationError(w, r, params, "invalid_scope", "'openid' scope is required")
+		return
+	}
+	challengeMode := params.Get("code_challenge_method")
+	if params.Get("code_challenge") != "" && challengeMode == "" {
+		challengeMode = "plain"
+	}
+	if challengeMode != "" && challengeMode != "S256" && challengeMode != "plain" {
+		issuer.authorizationError(w, r, params, "invalid_request", "unsupported code_challenge_method")
+		return
+	}
+
+	data := loginTmplData{ClientID: client.ID, Params: params, Login: params.Get("login_hint"), Users: issuer.config.Users}
+	if r.Method == http.MethodGet {
+		issuer.renderLogin(w, http.StatusOK, data)
+		return
+	}
+	login := r.PostForm.Get("login")
+	user, ok := issuer.config.user(login)
+	if !ok || (user.Password != "" && user.Password != r.PostForm.Get("password")) {
+		issuer.log.Infof("Login failed for user '%s'", login)
+		data.Login = login
+		data.Error = "Invalid login or password"
+		issuer.renderLogin(w, http.StatusUnauthorized, data)
+		return
+	}
+	code, err := randomString(32)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	g := &grant{
+		clientID:      client.ID,
+		redirectURI:   redirectURI,
+		user:          user,
+		scopes:        scopes,
+		nonce:         params.Get("nonce"),
+		authTime:      now,
+		codeChallenge: params.Get("code_challenge"),
+		challengeMode: challengeMode,
+		expiry:        now.Add(codeTTL),
+	}
+	// The first requested authentication context is considered as performed, to test step-up authentication
+	if acrValues := strings.Fields(params.Get("acr_values")); len(acrValues) > 0 {
+		g.acr = acrValues[0]
+	}
+	issuer.mutex.Lock()
+	issuer.purge(now)
+	issuer.codes[code] = g
+	issuer.mutex.Unlock()
+	issuer.log.Infof("User '%s' logged in for client '%s'", user.Login, client.ID)
+	issuer.respond(w, r, params, url.Values{"code": {code}})
+}
+
+func (issuer *Issuer) renderLogin(w http.ResponseWriter, status int, data loginTmplData) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := loginTmpl.Execute(w, data); err != nil {
+		issuer.log.Errorf("Unable to render login page: %v", err)
+	}
+}
+
+// authorizationError report an error to the client, as defined in RFC 6749, section 4.1.2.1
+func (issuer *Issuer) authorizationError(w http.ResponseWriter, r *http.Request, params url.Values, code string, description string) {
+	issuer.log.Infof("Authorization request rejected: %s: %s", code, description)
+	issuer.respond(w, r, params, url.Values{"error": {code}, "error_description": {description}})
+}
+
+// respond send the authorization response to the client redirect URI, in the requested response mode
+func (issuer *Issuer) respond(w http.ResponseWriter, r *http.Request, params url.Values, fields url.Values) {
+	if state := params.Get("state"); state != "" {
+		fields.Set("state", state)
+	}
+	redirectURI := params.Get("redirect_uri")
+	if params.Get("response_mode") == "form_post" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		_ = formPostTmpl.Execute(w, struct {
+			Action string
+			Fields url.Values
+		}{redirectURI, fields})
+		return
+	}
+	separator := "?"
+	if strings.Contains(redirectURI, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, redirectURI+separator+fields.Encode(), http.StatusSeeOther)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
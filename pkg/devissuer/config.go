@@ -0,0 +1,126 @@
+package devissuer
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config is the dev issuer configuration, usually loaded from a YAML file.
+type Config struct {
+	Issuer   string         `yaml:"issuer"`   // The issuer URL, as configured in oidc.issuerURL. May have a path (i.e. http://127.0.0.1:5556/dex)
+	TokenTTL string         `yaml:"tokenTTL"` // ID and access tokens validity. Default: 1h
+	Clients  []ClientConfig `yaml:"clients"`  // If empty, any client ID and redirect URI are accepted, without authentication
+	Users    []UserConfig   `yaml:"users"`
+	tokenTTL time.Duration
+}
+
+type ClientConfig struct {
+	ID           string   `yaml:"id"`
+	Secret       string   `yaml:"secret"`       // If empty, the client is a public one
+	RedirectURIs []string `yaml:"redirectURIs"` // If empty, any redirect URI is accepted
+}
+
+type UserConfig struct {
+	Login           string   `yaml:"login"`           // Also used as 'sub' and 'preferred_username' claims
+	Password        string   `yaml:"password"`        // If empty, any password is accepted
+	Name            string   `yaml:"name"`            // Default: login
+	Email           string   `yaml:"email"`           // Considered as verified, unless emailUnverified is set
+	EmailUnverified bool     `yaml:"emailUnverified"` // Issue 'email_verified: false'. Default: false
+	Groups          []string `yaml:"groups"`
+}
+
+// LoadConfig read the configuration from a YAML file. defaultIssuer is used if the file does not define one.
+func LoadConfig(fileName string, defaultIssuer string) (*Config, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+	config := &Config{}
+	decoder := yaml.NewDecoder(file)
+	decoder.SetStrict(true)
+	if err := decoder.Decode(config); err != nil {
+		return nil, fmt.Errorf("unable to parse '%s': %v", fileName, err)
+	}
+	if config.Issuer == "" {
+		config.Issuer = defaultIssuer
+	}
+	return config, nil
+}
+
+func (c *Config) validate() error {
+	u, err := url.Parse(c.Issuer)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("issuer '%s' is not a valid URL", c.Issuer)
+	}
+	c.Issuer = strings.TrimSuffix(c.Issuer, "/")
+	if c.TokenTTL == "" {
+		c.TokenTTL = "1h"
+	}
+	if c.tokenTTL, err = time.ParseDuration(c.TokenTTL); err != nil || c.tokenTTL <= 0 {
+		return fmt.Errorf("invalid tokenTTL value: %s", c.TokenTTL)
+	}
+	for i, client := range c.Clients {
+		if client.ID == "" {
+			return fmt.Errorf("clients[%d]: missing 'id'", i)
+		}
+	}
+	if len(c.Users) == 0 {
+		return fmt.Errorf("no user defined")
+	}
+	logins := make(map[string]bool)
+	for i := range c.Users {
+		user := &c.Users[i]
+		if user.Login == "" {
+			return fmt.Errorf("users[%d]: missing 'login'", i)
+		}
+		if logins[user.Login] {
+			return fmt.Errorf("user '%s' is defined twice", user.Login)
+		}
+		logins[user.Login] = true
+		if user.Name == "" {
+			user.Name = user.Login
+		}
+		if user.Groups == nil {
+			user.Groups = []string{}
+		}
+	}
+	return nil
+}
+
+func (c *Config) client(clientID string) (*ClientConfig, bool) {
+	if len(c.Clients) == 0 {
+		return &ClientConfig{ID: clientID}, true
+	}
+	for i := range c.Clients {
+		if c.Clients[i].ID == clientID {
+			return &c.Clients[i], true
+		}
+	}
+	return nil, false
+}
+
+func (c *Config) user(login string) (*UserConfig, bool) {
+	for i := range c.Users {
+		if c.Users[i].Login == login {
+			return &c.Users[i], true
+		}
+	}
+	return nil, false
+}
+
+func (client *ClientConfig) allowRedirectURI(redirectURI string) bool {
+	if len(client.RedirectURIs) == 0 {
+		return redirectURI != ""
+	}
+	for _, uri := range client.RedirectURIs {
+		if uri == redirectURI {
+			return true
+		}
+	}
+	return false
+}
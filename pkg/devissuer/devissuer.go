@@ -0,0 +1,143 @@
+package devissuer
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Authorization codes validity
+const codeTTL = time.Minute
+
+// Issuer is a minimal OIDC server, for development and integration testing only. It authenticates the users of its configuration
+// with a simple login form, and issues RS256 signed ID tokens holding their name, email and groups.
+// Supported: Discovery, authorization code flow (With PKCE, query or form_post response mode), refresh tokens, UserInfo
+// and Dex cross-client scopes.
+// All state (Signing key, codes, tokens) is in memory, and lost on restart.
+type Issuer struct {
+	config        *Config
+	log           *logrus.Entry
+	key           *jose.JSONWebKey
+	discovery     []byte
+	mux           *http.ServeMux
+	mutex         sync.Mutex
+	codes         map[string]*grant // By authorization code
+	accessTokens  map[string]*grant
+	refreshTokens map[string]*grant
+}
+
+// grant is a user authentication for a client, from which tokens are issued
+type grant struct {
+	clientID      string
+	redirectURI   string
+	user          *UserConfig
+	scopes        []string
+	nonce         string
+	acr           string
+	authTime      time.Time
+	codeChallenge string
+	challengeMode string
+	expiry        time.Time // Zero for refresh tokens
+}
+
+// New build an issuer from its configuration. A new signing key is generated on each call.
+func New(config *Config, log *logrus.Entry) (*Issuer, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate signing key: %v", err)
+	}
+	key := &jose.JSONWebKey{Key: privateKey, Algorithm: string(jose.RS256), Use: "sig"}
+	publicKey := key.Public()
+	thumbprint, err := publicKey.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	key.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+	issuer := &Issuer{
+		config:        config,
+		log:           log,
+		key:           key,
+		mux:           http.NewServeMux(),
+		codes:         make(map[string]*grant),
+		accessTokens:  make(map[string]*grant),
+		refreshTokens: make(map[string]*grant),
+	}
+	issuerURL, _ := url.Parse(config.Issuer)
+	base := issuerURL.Path
+	issuer.discovery, err = json.Marshal(map[string]interface{}{
+		"issuer":                                config.Issuer,
+		"authorization_endpoint":                config.Issuer + "/auth",
+		"token_endpoint":                        config.Issuer + "/token",
+		"userinfo_endpoint":                     config.Issuer + "/userinfo",
+		"jwks_uri":                              config.Issuer + "/keys",
+		"response_types_supported":              []string{"code"},
+		"response_modes_supported":              []string{"query", "form_post"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{string(jose.RS256)},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256", "plain"},
+		"scopes_supported":                      []string{"openid", "profile", "email", "groups", "offline_access"},
+		"claims_supported":                      []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "acr", "amr", "azp", "name", "preferred_username", "email", "email_verified", "groups"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	issuer.mux.HandleFunc(base+"/.well-known/openid-configuration", issuer.handleDiscovery)
+	issuer.mux.HandleFunc(base+"/keys", issuer.handleKeys)
+	issuer.mux.HandleFunc(base+"/auth", issuer.handleAuthorization)
+	issuer.mux.HandleFunc(base+"/token", issuer.handleToken)
+	issuer.mux.HandleFunc(base+"/userinfo", issuer.handleUserInfo)
+	return issuer, nil
+}
+
+// URL return the issuer URL, to be used as oidc.issuerURL
+func (issuer *Issuer) URL() string {
+	return issuer.config.Issuer
+}
+
+func (issuer *Issuer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	issuer.log.Debugf("%s %s", r.Method, r.URL)
+	issuer.mux.ServeHTTP(w, r)
+}
+
+func (issuer *Issuer) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(issuer.discovery)
+}
+
+func (issuer *Issuer) handleKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{issuer.key.Public()}})
+}
+
+// purge remove expired codes and access tokens. Must be called with the mutex held
+func (issuer *Issuer) purge(now time.Time) {
+	for _, grants := range []map[string]*grant{issuer.codes, issuer.accessTokens} {
+		for key, g := range grants {
+			if now.After(g.expiry) {
+				delete(grants, key)
+			}
+		}
+	}
+}
+
+func randomString(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
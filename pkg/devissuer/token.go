@@ -0,0 +1,242 @@
+package devissuer
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"dexgate/internal/oidcapp"
+	"encoding/base64"
+	"encoding/json"
+	"gopkg.in/square/go-jose.v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// tokenError is an error response of the token endpoint. See RFC 6749, section 5.2
+type tokenError struct {
+	status      int
+	code        string
+	description string
+}
+
+// handleToken exchange an authorization code or a refresh token for tokens
+func (issuer *Issuer) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		issuer.tokenError(w, &tokenError{http.StatusBadRequest, "invalid_request", err.Error()})
+		return
+	}
+	client, tErr := issuer.authenticateClient(r)
+	if tErr != nil {
+		issuer.tokenError(w, tErr)
+		return
+	}
+	var g *grant
+	refreshToken := ""
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		g, tErr = issuer.redeemCode(r, client)
+	case "refresh_token":
+		refreshToken = r.PostForm.Get("refresh_token")
+		issuer.mutex.Lock()
+		g = issuer.refreshTokens[refreshToken]
+		issuer.mutex.Unlock()
+		if g == nil || g.clientID != client.ID {
+			tErr = &tokenError{http.StatusBadRequest, "invalid_grant", "unknown refresh token"}
+		}
+	default:
+		tErr = &tokenError{http.StatusBadRequest, "unsupported_grant_type", "only 'authorization_code' and 'refresh_token' grant types are supported"}
+	}
+	if tErr != nil {
+		issuer.tokenError(w, tErr)
+		return
+	}
+
+	now := time.Now()
+	accessToken, err := randomString(32)
+	if err != nil {
+		issuer.tokenError(w, &tokenError{http.StatusInternalServerError, "server_error", err.Error()})
+		return
+	}
+	idToken, err := issuer.signIDToken(g, accessToken, now)
+	if err != nil {
+		issuer.tokenError(w, &tokenError{http.StatusInternalServerError, "server_error", err.Error()})
+		return
+	}
+	response := map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(issuer.config.tokenTTL.Seconds()),
+		"id_token":     idToken,
+		"scope":        strings.Join(g.scopes, " "),
+	}
+	issuer.mutex.Lock()
+	issuer.purge(now)
+	access := *g
+	access.expiry = now.Add(issuer.config.tokenTTL)
+	issuer.accessTokens[accessToken] = &access
+	if refreshToken == "" && contains(g.scopes, "offline_access") {
+		if refreshToken, err = randomString(32); err == nil {
+			refresh := *g
+			refresh.expiry = time.Time{}
+			issuer.refreshTokens[refreshToken] = &refresh
+		}
+	}
+	issuer.mutex.Unlock()
+	if err != nil {
+		issuer.tokenError(w, &tokenError{http.StatusInternalServerError, "server_error", err.Error()})
+		return
+	}
+	if refreshToken != "" {
+		response["refresh_token"] = refreshToken
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// authenticateClient check the client credentials, provided in a basic authorization header or in the form.
+// A client without secret only has to provide its ID.
+func (issuer *Issuer) authenticateClient(r *http.Request) (*ClientConfig, *tokenError) {
+	clientID, secret, ok := r.BasicAuth()
+	if ok {
+		// Basic credentials are form-urlencoded. See RFC 6749, section 2.3.1
+		var idErr, secretErr error
+		clientID, idErr = url.QueryUnescape(clientID)
+		secret, secretErr = url.QueryUnescape(secret)
+		if idErr != nil || secretErr != nil {
+			return nil, &tokenError{http.StatusUnauthorized, "invalid_client", "invalid client credentials encoding"}
+		}
+	} else {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	client, ok := issuer.config.client(clientID)
+	if !ok || clientID == "" {
+		return nil, &tokenError{http.StatusUnauthorized, "invalid_client", "unknown client"}
+	}
+	if client.Secret != "" && subtle.ConstantTimeCompare([]byte(client.Secret), []byte(secret)) != 1 {
+		return nil, &tokenError{http.StatusUnauthorized, "invalid_client", "invalid client secret"}
+	}
+	return client, nil
+}
+
+// redeemCode return the grant of an authorization code. A code can be used only once.
+func (issuer *Issuer) redeemCode(r *http.Request, client *ClientConfig) (*grant, *tokenError) {
+	code := r.PostForm.Get("code")
+	issuer.mutex.Lock()
+	g := issuer.codes[code]
+	delete(issuer.codes, code)
+	issuer.mutex.Unlock()
+	if g == nil || time.Now().After(g.expiry) {
+		return nil, &tokenError{http.StatusBadRequest, "invalid_grant", "unknown or expired authorization code"}
+	}
+	if g.clientID != client.ID {
+		return nil, &tokenError{http.StatusBadRequest, "invalid_grant", "authorization code issued to another client"}
+	}
+	if g.redirectURI != r.PostForm.Get("redirect_uri") {
+		return nil, &tokenError{http.StatusBadRequest, "invalid_grant", "redirect_uri does not match the authorization request"}
+	}
+	// PKCE. See RFC 7636, section 4.6
+	if g.codeChallenge != "" {
+		verifier := r.PostForm.Get("code_verifier")
+		if g.challengeMode == "S256" {
+			sum := sha256.Sum256([]byte(verifier))
+			verifier = base64.RawURLEncoding.EncodeToString(sum[:])
+		}
+		if verifier == "" || verifier != g.codeChallenge {
+			return nil, &tokenError{http.StatusBadRequest, "invalid_grant", "invalid code_verifier"}
+		}
+	}
+	return g, nil
+}
+
+func (issuer *Issuer) signIDToken(g *grant, accessToken string, now time.Time) (string, error) {
+	claims := userClaims(g.user)
+	claims["iss"] = issuer.config.Issuer
+	claims["aud"] = g.clientID
+	// Dex cross-client scopes: The token is issued for the peers, on behalf of the client. Any peer is trusted
+	var peers []string
+	for _, scope := range g.scopes {
+		if strings.HasPrefix(scope, oidcapp.CrossClientScopePrefix) {
+			peers = append(peers, strings.TrimPrefix(scope, oidcapp.CrossClientScopePrefix))
+		}
+	}
+	if len(peers) > 0 {
+		claims["aud"] = peers
+		claims["azp"] = g.clientID
+	}
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(issuer.config.tokenTTL).Unix()
+	claims["auth_time"] = g.authTime.Unix()
+	claims["amr"] = []string{"pwd"}
+	if g.nonce != "" {
+		claims["nonce"] = g.nonce
+	}
+	if g.acr != "" {
+		claims["acr"] = g.acr
+	}
+	// Left half of the access token hash. See https://openid.net/specs/openid-connect-core-1_0.html#CodeIDToken
+	sum := sha256.Sum256([]byte(accessToken))
+	claims["at_hash"] = base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: issuer.key}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return "", err
+	}
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	return jws.CompactSerialize()
+}
+
+// userClaims are the user identity claims, provided in the ID token and by the UserInfo endpoint, whatever the requested scopes
+func userClaims(user *UserConfig) map[string]interface{} {
+	claims := map[string]interface{}{
+		"sub":                user.Login,
+		"name":               user.Name,
+		"preferred_username": user.Login,
+		"groups":             user.Groups,
+	}
+	if user.Email != "" {
+		claims["email"] = user.Email
+		claims["email_verified"] = !user.EmailUnverified
+	}
+	return claims
+}
+
+func (issuer *Issuer) handleUserInfo(w http.ResponseWriter, r *http.Request) {
+	token := ""
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		token = strings.TrimPrefix(authorization, "Bearer ")
+	}
+	issuer.mutex.Lock()
+	g := issuer.accessTokens[token]
+	issuer.mutex.Unlock()
+	if g == nil || time.Now().After(g.expiry) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Invalid access token", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(userClaims(g.user))
+}
+
+func (issuer *Issuer) tokenError(w http.ResponseWriter, tErr *tokenError) {
+	issuer.log.Infof("Token request rejected: %s: %s", tErr.code, tErr.description)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if tErr.status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="devissuer"`)
+	}
+	w.WriteHeader(tErr.status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": tErr.code, "error_description": tErr.description})
+}